@@ -0,0 +1,477 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errNoSuchClient = errors.New("no such client")
+
+// AdminConfig specifies the admin console database, which accepts SHOW and
+// KILL commands instead of LISTEN.  It's disabled if Database is empty.
+type AdminConfig struct {
+	Database string
+	Users    []AuthConfig
+}
+
+// The columns of the result of each SHOW command supported by the admin
+// console.
+var adminShowColumns = map[string][]string{
+	"clients":  {"id", "addr", "database", "user", "connected_at", "channels", "patterns", "queued", "consumer"},
+	"channels": {"channel", "listeners", "upstream"},
+	"servers":  {"type", "connection", "state", "state_changed_at", "reconnects", "channels", "last_error"},
+	"stats":    {"name", "value"},
+	"config":   {"key", "value"},
+}
+
+// adminConsole provides the information shown by the admin console and the
+// HTTP API, and lets them kill clients and reload the configuration.
+type adminConsole struct {
+	config     *config
+	configFile string
+	clients    *clientRegistry
+	upstream   *upstreamStatus
+	// set once the listener has been created
+	listener *pqListenerWrapper
+}
+
+func newAdminConsole(cfg *config, configFile string) *adminConsole {
+	return &adminConsole{
+		config:     cfg,
+		configFile: configFile,
+		clients:    newClientRegistry(),
+		upstream:   &upstreamStatus{},
+	}
+}
+
+func (a *adminConsole) reload() error {
+	err := reloadConfigFile(a.configFile)
+	if err != nil {
+		elog.Warningf("could not reload configuration file: %s", err)
+		return err
+	}
+	elog.Logf("configuration file reloaded")
+	return nil
+}
+
+// auditActor identifies who performed an admin action in the audit log.
+type auditActor struct {
+	client   string
+	database string
+	user     string
+}
+
+// adminSession is the admin console as used by a single client of the admin
+// console database, or a single HTTP API request.  Actions which change
+// something are recorded in the audit log.
+type adminSession struct {
+	*adminConsole
+	actor auditActor
+}
+
+func (s *adminSession) Kill(id int64) error {
+	err := s.clients.Kill(id)
+	s.record("kill", strconv.FormatInt(id, 10), err)
+	return err
+}
+
+func (s *adminSession) Reload() error {
+	err := s.reload()
+	s.record("reload", s.configFile, err)
+	return err
+}
+
+func (s *adminSession) record(action, target string, err error) {
+	r := auditRecord{
+		Event:    "admin",
+		Client:   s.actor.client,
+		Database: s.actor.database,
+		User:     s.actor.user,
+		Action:   action,
+		Target:   target,
+		Result:   "success",
+	}
+	if err != nil {
+		r.Result = "failure"
+		r.Reason = err.Error()
+	}
+	audit.Record(r)
+}
+
+// clientRegistry keeps track of all connected clients.
+type clientRegistry struct {
+	lock    sync.Mutex
+	nextID  int64
+	clients map[int64]*FrontendConnection
+}
+
+func newClientRegistry() *clientRegistry {
+	return &clientRegistry{
+		nextID:  1,
+		clients: make(map[int64]*FrontendConnection),
+	}
+}
+
+// Adds c to the registry and assigns it an ID.
+func (r *clientRegistry) Register(c *FrontendConnection) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	c.id = r.nextID
+	r.nextID++
+	r.clients[c.id] = c
+}
+
+func (r *clientRegistry) Unregister(c *FrontendConnection) {
+	r.lock.Lock()
+	delete(r.clients, c.id)
+	r.lock.Unlock()
+}
+
+// Returns the clients ordered by ID.
+func (r *clientRegistry) List() []*FrontendConnection {
+	r.lock.Lock()
+	clients := make([]*FrontendConnection, 0, len(r.clients))
+	for _, c := range r.clients {
+		clients = append(clients, c)
+	}
+	r.lock.Unlock()
+
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].id < clients[j].id
+	})
+	return clients
+}
+
+func (r *clientRegistry) Kill(id int64) error {
+	r.lock.Lock()
+	c, ok := r.clients[id]
+	r.lock.Unlock()
+	if !ok {
+		return errNoSuchClient
+	}
+	c.kill()
+	return nil
+}
+
+// upstreamStatus tracks the state of the connection to the server.  It's also
+// a prometheus.Collector exporting whether the connection is up and how long
+// ago it was established.
+type upstreamStatus struct {
+	lock       sync.Mutex
+	connected  bool
+	changedAt  time.Time
+	reconnects int
+	lastError  string
+	// zero until the first successful connection
+	connectedAt time.Time
+}
+
+var upstreamConnectedDesc = prometheus.NewDesc(
+	"allas_upstream_connected",
+	"whether allas is currently connected to the PostgreSQL server",
+	nil,
+	nil,
+)
+
+var upstreamSecondsSinceConnectDesc = prometheus.NewDesc(
+	"allas_upstream_seconds_since_connect",
+	"how long ago allas last established a connection to the PostgreSQL server",
+	nil,
+	nil,
+)
+
+func (s *upstreamStatus) SetConnected(reconnect bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	// changedAt is the time the previous connection was lost
+	if !s.connected && !s.connectedAt.IsZero() {
+		MetricUpstreamOutageDuration.Observe(now.Sub(s.changedAt).Seconds())
+	}
+	s.connected = true
+	s.changedAt = now
+	s.connectedAt = now
+	if reconnect {
+		s.reconnects++
+	}
+}
+
+func (s *upstreamStatus) SetDisconnected(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.connected || s.changedAt.IsZero() {
+		s.changedAt = time.Now()
+	}
+	s.connected = false
+	if err != nil {
+		s.lastError = err.Error()
+	}
+}
+
+func (s *upstreamStatus) Snapshot() (connected bool, changedAt time.Time, reconnects int, lastError string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.connected, s.changedAt, s.reconnects, s.lastError
+}
+
+func (s *upstreamStatus) Describe(ch chan<- *prometheus.Desc) {
+	ch <- upstreamConnectedDesc
+	ch <- upstreamSecondsSinceConnectDesc
+}
+
+func (s *upstreamStatus) Collect(ch chan<- prometheus.Metric) {
+	s.lock.Lock()
+	connected, connectedAt := s.connected, s.connectedAt
+	s.lock.Unlock()
+
+	var up float64
+	if connected {
+		up = 1
+	}
+	ch <- prometheus.MustNewConstMetric(upstreamConnectedDesc, prometheus.GaugeValue, up)
+	if !connectedAt.IsZero() {
+		ch <- prometheus.MustNewConstMetric(upstreamSecondsSinceConnectDesc, prometheus.GaugeValue, time.Since(connectedAt).Seconds())
+	}
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func formatBool(b bool) string {
+	if b {
+		return "t"
+	}
+	return "f"
+}
+
+var (
+	connInfoPasswordRegexp = regexp.MustCompile(`password\s*=\s*('(?:[^'\\]|\\.)*'|\S+)`)
+	connURLPasswordRegexp  = regexp.MustCompile(`^(postgres(?:ql)?://[^:@/]*):[^@/]*@`)
+)
+
+// Removes the password from a connection string.
+func sanitizeConnInfo(connInfo string) string {
+	connInfo = connInfoPasswordRegexp.ReplaceAllString(connInfo, "password=********")
+	return connURLPasswordRegexp.ReplaceAllString(connInfo, "$1:********@")
+}
+
+func (a *adminConsole) Show(what string) ([][]string, error) {
+	switch what {
+	case "clients":
+		return a.showClients(), nil
+	case "channels":
+		return a.showChannels(), nil
+	case "servers":
+		return a.showServers(), nil
+	case "stats":
+		return a.showStats()
+	case "config":
+		return a.showConfig(), nil
+	default:
+		return nil, fmt.Errorf("unrecognized SHOW command %q", what)
+	}
+}
+
+func (a *adminConsole) showClients() [][]string {
+	var rows [][]string
+	for _, c := range a.clients.List() {
+		info := c.info()
+		rows = append(rows, []string{
+			strconv.FormatInt(info.id, 10),
+			info.addr,
+			info.database,
+			info.user,
+			formatTime(info.connectedAt),
+			strconv.Itoa(len(info.channels)),
+			strconv.Itoa(len(info.patterns)),
+			strconv.Itoa(info.queued),
+			info.consumer,
+		})
+	}
+	return rows
+}
+
+type channelInfo struct {
+	channel   string
+	listeners int
+	// whether the channel is LISTENed on in the server
+	upstream bool
+}
+
+// Returns the channels clients are listening on and the channels LISTENed on
+// in the server, ordered by name.
+// Returns the channels listened on by clients or in the server.  The channels
+// are identified by their names in the server, i.e. including the channel
+// prefix of the client's database.
+func (a *adminConsole) channels() []channelInfo {
+	listeners := make(map[string]int)
+	for _, c := range a.clients.List() {
+		for _, channel := range c.info().upstreamChannels {
+			listeners[channel]++
+		}
+	}
+	upstream := make(map[string]bool)
+	if a.listener != nil {
+		for _, channel := range a.listener.Channels() {
+			upstream[channel] = true
+			if _, ok := listeners[channel]; !ok {
+				listeners[channel] = 0
+			}
+		}
+	}
+
+	channels := make([]string, 0, len(listeners))
+	for channel := range listeners {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+
+	infos := make([]channelInfo, len(channels))
+	for i, channel := range channels {
+		infos[i] = channelInfo{channel, listeners[channel], upstream[channel]}
+	}
+	return infos
+}
+
+func (a *adminConsole) showChannels() [][]string {
+	var rows [][]string
+	for _, info := range a.channels() {
+		rows = append(rows, []string{info.channel, strconv.Itoa(info.listeners), formatBool(info.upstream)})
+	}
+	return rows
+}
+
+// Returns the number of channels LISTENed on in the server.
+func (a *adminConsole) numUpstreamChannels() int {
+	if a.listener == nil {
+		return 0
+	}
+	return len(a.listener.Channels())
+}
+
+func (a *adminConsole) showServers() [][]string {
+	connected, changedAt, reconnects, lastError := a.upstream.Snapshot()
+	state := "disconnected"
+	if connected {
+		state = "connected"
+	}
+	return [][]string{{
+		"listener",
+		sanitizeConnInfo(a.config.ClientConnInfo),
+		state,
+		formatTime(changedAt),
+		strconv.Itoa(reconnects),
+		strconv.Itoa(a.numUpstreamChannels()),
+		lastError,
+	}}
+}
+
+// Returns the sum of the values of all counters and gauges in c.
+func metricValue(c prometheus.Collector) (float64, error) {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+
+	var sum float64
+	var err error
+	for m := range ch {
+		var d dto.Metric
+		writeErr := m.Write(&d)
+		if writeErr != nil {
+			err = writeErr
+			continue
+		}
+		if d.Counter != nil {
+			sum += d.Counter.GetValue()
+		} else if d.Gauge != nil {
+			sum += d.Gauge.GetValue()
+		}
+	}
+	return sum, err
+}
+
+func (a *adminConsole) showStats() ([][]string, error) {
+	stats := []struct {
+		name   string
+		metric prometheus.Collector
+	}{
+		{"client_connections", MetricClientConnections},
+		{"notifications_received", MetricNotificationsReceived},
+		{"notifications_dispatched", MetricNotificationsDispatched},
+		{"notifications_coalesced", MetricNotificationsCoalesced},
+		{"notifications_filtered", MetricNotificationsFiltered},
+		{"notifications_rate_limited", MetricNotificationsRateLimited},
+		{"notifications_dropped", MetricNotificationsDropped},
+		{"listens_executed", MetricListensExecuted},
+		{"unlistens_executed", MetricUnlistensExecuted},
+		{"slow_clients_terminated", MetricSlowClientsTerminated},
+		{"channel_permission_denied", MetricChannelPermissionDenied},
+		{"upstream_ping_failures", MetricUpstreamPingFailures},
+		{"upstream_ping_timeouts", MetricUpstreamPingTimeouts},
+		{"upstream_connection_attempts_failed", MetricUpstreamConnectionAttemptsFailed},
+		{"upstream_disconnects", MetricUpstreamDisconnects},
+		{"upstream_reconnects", MetricUpstreamReconnects},
+	}
+
+	var rows [][]string
+	for _, stat := range stats {
+		value, err := metricValue(stat.metric)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, []string{stat.name, strconv.FormatFloat(value, 'f', -1, 64)})
+	}
+	return rows, nil
+}
+
+func (a *adminConsole) showConfig() [][]string {
+	configLock.RLock()
+	defer configLock.RUnlock()
+
+	cfg := a.config
+	var databases []string
+	for _, db := range cfg.Databases {
+		databases = append(databases, db.name)
+	}
+	return [][]string{
+		{"listen", fmt.Sprintf("%s:%d", cfg.Listen.Host, cfg.Listen.Port)},
+		{"connect", sanitizeConnInfo(cfg.ClientConnInfo)},
+		{"forward_server_parameters", formatBool(cfg.ForwardServerParameters)},
+		{"databases", strings.Join(databases, ",")},
+		{"upstream.min_reconnect_interval", cfg.Upstream.MinReconnectInterval.String()},
+		{"upstream.max_reconnect_interval", cfg.Upstream.MaxReconnectInterval.String()},
+		{"upstream.reconnect_jitter", strconv.FormatFloat(cfg.Upstream.ReconnectJitter, 'f', -1, 64)},
+		{"upstream.ping_interval", cfg.Upstream.PingInterval.String()},
+		{"upstream.ping_timeout", cfg.Upstream.PingTimeout.String()},
+		{"upstream.tcp_keepalive_interval", cfg.Upstream.TCPKeepAliveInterval.String()},
+		{"upstream.tcp_user_timeout", cfg.Upstream.TCPUserTimeout.String()},
+		{"upstream.channels", strings.Join(cfg.Upstream.Channels, ",")},
+		{"upstream.max_upstream_channels", strconv.Itoa(cfg.Upstream.MaxChannels)},
+		{"delivery.max_batch_size", strconv.Itoa(cfg.Delivery.MaxBatchSize)},
+		{"delivery.max_batch_latency", cfg.Delivery.MaxBatchLatency.String()},
+		{"delivery.rate_limits", strconv.Itoa(len(cfg.Delivery.RateLimits))},
+		{"replay", strconv.Itoa(len(cfg.Replay))},
+		{"coalesce", strconv.Itoa(len(cfg.Coalesce))},
+		{"transformers", strconv.Itoa(len(cfg.Transformers))},
+		{"payload_fetch", strconv.Itoa(len(cfg.PayloadFetch))},
+		{"durable_log.directory", cfg.DurableLog.Directory},
+		{"admin.database", cfg.Admin.Database},
+		{"http_api.enabled", formatBool(cfg.HTTPAPI.Enabled)},
+		{"prometheus.enabled", formatBool(cfg.Prometheus.Enabled)},
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSanitizeConnInfo(t *testing.T) {
+	var tests = []struct {
+		connInfo string
+		expected string
+	}{
+		{"host=localhost port=5432", "host=localhost port=5432"},
+		{"host=db password=secret user=allas", "host=db password=******** user=allas"},
+		{`host=db password = 'it\'s secret'`, "host=db password=********"},
+		{"postgres://allas:secret@db/postgres", "postgres://allas:********@db/postgres"},
+		{"postgres://allas@db/postgres", "postgres://allas@db/postgres"},
+	}
+	for _, ts := range tests {
+		if got := sanitizeConnInfo(ts.connInfo); got != ts.expected {
+			t.Errorf("sanitizeConnInfo(%q) = %q; expected %q", ts.connInfo, got, ts.expected)
+		}
+	}
+}
+
+func TestRestrictQuery(t *testing.T) {
+	var tests = []struct {
+		query   string
+		admin   bool
+		allowed bool
+	}{
+		{"show clients", true, true},
+		{"show clients", false, false},
+		{"kill 1", false, false},
+		{"select 1", true, true},
+		{"listen foo", true, false},
+		{"listen foo", false, true},
+	}
+	for _, ts := range tests {
+		q, err := ParseQuery(ts.query)
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		_, rejected := RestrictQuery(q, ts.admin).(rejectedQuery)
+		if rejected == ts.allowed {
+			t.Errorf("query %q with admin=%v: rejected is %v", ts.query, ts.admin, rejected)
+		}
+	}
+}
+
+func outageCount(t *testing.T) uint64 {
+	var m dto.Metric
+	err := MetricUpstreamOutageDuration.(prometheus.Metric).Write(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestUpstreamStatusOutage(t *testing.T) {
+	initTestMetrics(t)
+
+	var s upstreamStatus
+	before := outageCount(t)
+
+	// failing to connect during startup is not an outage
+	s.SetDisconnected(errors.New("connection refused"))
+	s.SetConnected(false)
+	if n := outageCount(t) - before; n != 0 {
+		t.Fatalf("expected no outages, got %d", n)
+	}
+
+	s.SetDisconnected(errors.New("connection reset"))
+	lostAt := s.changedAt
+	s.SetDisconnected(errors.New("connection refused"))
+	if !s.changedAt.Equal(lostAt) {
+		t.Fatalf("failed connection attempt changed the start of the outage")
+	}
+	time.Sleep(time.Millisecond)
+	s.SetConnected(true)
+	if n := outageCount(t) - before; n != 1 {
+		t.Fatalf("expected one outage, got %d", n)
+	}
+
+	connected, _, reconnects, _ := s.Snapshot()
+	if !connected || reconnects != 1 {
+		t.Fatalf("unexpected state connected=%v reconnects=%d", connected, reconnects)
+	}
+}
+
+func TestAdminChannelsWithPrefixes(t *testing.T) {
+	a := newAdminConsole(&config{}, "")
+	a.listener = &pqListenerWrapper{channels: map[string]struct{}{
+		"a_foo": {},
+		"b_foo": {},
+	}}
+	databases := []*virtualDatabase{
+		{name: "a", channelPrefix: "a_"},
+		{name: "b", channelPrefix: "b_"},
+	}
+	for _, listen := range []struct {
+		database *virtualDatabase
+		channel  string
+	}{
+		{databases[0], "a_foo"},
+		{databases[0], "a_foo"},
+		{databases[1], "b_foo"},
+		{databases[1], "b_bar"},
+	} {
+		c := &FrontendConnection{
+			database:       listen.database,
+			queue:          newNotificationQueue(SlowClientTerminate, time.Second, 1, nil),
+			listenChannels: map[string]struct{}{listen.channel: {}},
+		}
+		a.clients.Register(c)
+	}
+
+	expected := []channelInfo{
+		{"a_foo", 2, true},
+		{"b_bar", 1, false},
+		{"b_foo", 1, true},
+	}
+	channels := a.channels()
+	if len(channels) != len(expected) {
+		t.Fatalf("got channels %+v; expected %+v", channels, expected)
+	}
+	for i := range channels {
+		if channels[i] != expected[i] {
+			t.Fatalf("got channels %+v; expected %+v", channels, expected)
+		}
+	}
+}
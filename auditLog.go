@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// SyncPolicy specifies when the audit log or the durable log is flushed to
+// disk.
+type SyncPolicy int
+
+const (
+	// fsync after every record
+	SyncAlways SyncPolicy = iota
+	// fsync every SyncInterval of the configuration if something has been
+	// written
+	SyncInterval
+	// leave it to the operating system
+	SyncNever
+)
+
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch s {
+	case "always":
+		return SyncAlways, nil
+	case "interval":
+		return SyncInterval, nil
+	case "never":
+		return SyncNever, nil
+	default:
+		return 0, fmt.Errorf("invalid sync policy %q", s)
+	}
+}
+
+type AuditLogConfig struct {
+	Enabled      bool
+	File         string
+	SyncPolicy   SyncPolicy
+	SyncInterval time.Duration
+}
+
+// auditRecord is a single line of the audit log.
+type auditRecord struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	Client   string    `json:"client,omitempty"`
+	Database string    `json:"database,omitempty"`
+	User     string    `json:"user,omitempty"`
+	Channel  string    `json:"channel,omitempty"`
+	Pattern  string    `json:"pattern,omitempty"`
+	Action   string    `json:"action,omitempty"`
+	Target   string    `json:"target,omitempty"`
+	Result   string    `json:"result,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+	SQLState string    `json:"sqlstate,omitempty"`
+}
+
+// auditLog records authentication, subscription and admin events to an
+// append-only file, one JSON object per line.  It's separate from elog so
+// that the records can be kept and protected differently from the rest of
+// the logs.
+type auditLog struct {
+	policy SyncPolicy
+
+	lock  sync.Mutex
+	f     *os.File
+	dirty bool
+}
+
+// The audit log, or nil if it's not enabled.  All methods of auditLog can be
+// called on a nil one.
+var audit *auditLog
+
+func openAuditLog(cfg AuditLogConfig) (*auditLog, error) {
+	f, err := os.OpenFile(cfg.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	a := &auditLog{
+		policy: cfg.SyncPolicy,
+		f:      f,
+	}
+	if cfg.SyncPolicy == SyncInterval {
+		go a.syncer(cfg.SyncInterval)
+	}
+	return a, nil
+}
+
+func (a *auditLog) syncer(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		a.lock.Lock()
+		if a.dirty {
+			err := a.f.Sync()
+			if err != nil {
+				elog.Errorf("could not fsync the audit log: %s", err)
+			}
+			a.dirty = false
+		}
+		a.lock.Unlock()
+	}
+}
+
+// Appends r to the audit log.  Errors are logged, but otherwise ignored;
+// we'd rather keep serving clients than refuse to do anything.
+func (a *auditLog) Record(r auditRecord) {
+	if a == nil {
+		return
+	}
+	r.Time = time.Now().UTC()
+	line, err := json.Marshal(r)
+	if err != nil {
+		panic(err)
+	}
+	line = append(line, '\n')
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	_, err = a.f.Write(line)
+	if err != nil {
+		elog.Errorf("could not write to the audit log: %s", err)
+		return
+	}
+	switch a.policy {
+	case SyncAlways:
+		err = a.f.Sync()
+		if err != nil {
+			elog.Errorf("could not fsync the audit log: %s", err)
+		}
+	case SyncInterval:
+		a.dirty = true
+	}
+}
+
+// Returns the reason recorded in the audit log for a client disconnecting
+// because of err.
+func disconnectReason(err error) string {
+	switch err {
+	case errGracefulTermination:
+		return "graceful"
+	case errClientCouldNotKeepUp:
+		return "slow_client"
+	case errLostServerConnection:
+		return "lost_server"
+	case errAdminShutdown:
+		return "admin"
+	default:
+		return "error"
+	}
+}
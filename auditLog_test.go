@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	for _, policy := range []SyncPolicy{SyncAlways, SyncNever} {
+		a, err := openAuditLog(AuditLogConfig{File: path, SyncPolicy: policy, SyncInterval: time.Second})
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.Record(auditRecord{Event: "listen", Client: "1.2.3.4:5", Database: "db", User: "u", Channel: "foo"})
+		a.Record(auditRecord{Event: "disconnect", Client: "1.2.3.4:5", Reason: disconnectReason(errClientCouldNotKeepUp)})
+		_ = a.f.Close()
+	}
+
+	fh, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+
+	var records []map[string]interface{}
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		var r map[string]interface{}
+		err := json.Unmarshal(scanner.Bytes(), &r)
+		if err != nil {
+			t.Fatalf("could not parse %q: %s", scanner.Text(), err)
+		}
+		records = append(records, r)
+	}
+	if len(records) != 4 {
+		t.Fatalf("expected 4 records, found %d", len(records))
+	}
+	if records[2]["event"] != "listen" || records[2]["channel"] != "foo" || records[2]["time"] == nil {
+		t.Errorf("unexpected record %v", records[2])
+	}
+	if records[3]["reason"] != "slow_client" || records[3]["channel"] != nil {
+		t.Errorf("unexpected record %v", records[3])
+	}
+
+	var disabled *auditLog
+	disabled.Record(auditRecord{Event: "listen"})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// channelPattern matches notification channel names.  Clients specify
+// patterns using the syntax of SQL LIKE, whereas the configuration file uses
+// shell-style globs.
+type channelPattern struct {
+	text string
+	re   *regexp.Regexp
+}
+
+var errLikePatternEndsWithEscape = errors.New("LIKE pattern must not end with escape character")
+
+// Compiles a LIKE pattern: % matches any sequence of characters, _ matches
+// any single character, and a backslash escapes the character following it.
+func newLikePattern(pattern string) (*channelPattern, error) {
+	var sb strings.Builder
+	sb.WriteByte('^')
+	escaped := false
+	for _, r := range pattern {
+		if escaped {
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+			escaped = false
+			continue
+		}
+		switch r {
+		case '\\':
+			escaped = true
+		case '%':
+			sb.WriteString("(?s:.*)")
+		case '_':
+			sb.WriteString("(?s:.)")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	if escaped {
+		return nil, errLikePatternEndsWithEscape
+	}
+	sb.WriteByte('$')
+	return &channelPattern{
+		text: pattern,
+		re:   regexp.MustCompile(sb.String()),
+	}, nil
+}
+
+// Returns a LIKE pattern matching s and nothing else.
+func escapeLikePattern(s string) string {
+	var sb strings.Builder
+	for _, r := range s {
+		switch r {
+		case '\\', '%', '_':
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+// Compiles a glob pattern: * matches any sequence of characters and ? matches
+// any single character.  Unlike path.Match, no character is special.
+func newGlobPattern(pattern string) *channelPattern {
+	var sb strings.Builder
+	sb.WriteByte('^')
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			sb.WriteString("(?s:.*)")
+		case '?':
+			sb.WriteString("(?s:.)")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	sb.WriteByte('$')
+	return &channelPattern{
+		text: pattern,
+		re:   regexp.MustCompile(sb.String()),
+	}
+}
+
+func (p *channelPattern) Match(channel string) bool {
+	return p.re.MatchString(channel)
+}
+
+func (p *channelPattern) String() string {
+	return p.text
+}
+
+// channelACL decides which channels clients of a virtual database may listen
+// on.  A channel is allowed if it matches one of the allowed patterns (or
+// there are none) and none of the denied ones.
+type channelACL struct {
+	allowed []*channelPattern
+	denied  []*channelPattern
+}
+
+func (acl *channelACL) Allowed(channel string) bool {
+	for _, p := range acl.denied {
+		if p.Match(channel) {
+			return false
+		}
+	}
+	if len(acl.allowed) == 0 {
+		return true
+	}
+	for _, p := range acl.allowed {
+		if p.Match(channel) {
+			return true
+		}
+	}
+	return false
+}
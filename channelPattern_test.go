@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestChannelPatterns(t *testing.T) {
+	var tests = []struct {
+		like    string
+		channel string
+		match   bool
+	}{
+		{"orders_%", "orders_tenant_123", true},
+		{"orders_%", "orders_", true},
+		{"orders_%", "order", false},
+		{"orders\\_%", "orders_x", true},
+		{"orders\\_%", "ordersXx", false},
+		{"a_c", "abc", true},
+		{"a_c", "abbc", false},
+		{"a.c", "abc", false},
+		{"%", "", true},
+	}
+
+	for n, ts := range tests {
+		p, err := newLikePattern(ts.like)
+		if err != nil {
+			t.Fatalf("test %d failed: unexpected error %q", n, err)
+		}
+		if p.Match(ts.channel) != ts.match {
+			t.Errorf("test %d failed: LIKE %q on %q did not return %v", n, ts.like, ts.channel, ts.match)
+		}
+	}
+
+	_, err := newLikePattern("foo\\")
+	if err != errLikePatternEndsWithEscape {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	if !newGlobPattern("audit.*").Match("audit.invoices") {
+		t.Errorf("glob pattern did not match")
+	}
+	if newGlobPattern("audit.?").Match("audit.xy") {
+		t.Errorf("glob pattern matched unexpectedly")
+	}
+
+	p, err := newLikePattern(escapeLikePattern("a_%\\") + "%")
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if !p.Match("a_%\\foo") || p.Match("ab%\\foo") || p.Match("a_x\\foo") {
+		t.Errorf("escaped LIKE pattern %q matched incorrectly", p)
+	}
+}
+
+func TestChannelACL(t *testing.T) {
+	acl := channelACL{
+		allowed: []*channelPattern{newGlobPattern("orders_*"), newGlobPattern("audit")},
+		denied:  []*channelPattern{newGlobPattern("orders_secret*")},
+	}
+	var tests = []struct {
+		channel string
+		allowed bool
+	}{
+		{"orders_1", true},
+		{"audit", true},
+		{"audit_1", false},
+		{"orders_secret", false},
+		{"invoices", false},
+	}
+	for _, ts := range tests {
+		if acl.Allowed(ts.channel) != ts.allowed {
+			t.Errorf("Allowed(%q) did not return %v", ts.channel, ts.allowed)
+		}
+	}
+
+	var empty channelACL
+	if !empty.Allowed("anything") {
+		t.Errorf("empty ACL did not allow a channel")
+	}
+}
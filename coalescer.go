@@ -0,0 +1,84 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// CoalesceConfig specifies the coalescing window of all channels matching
+// Channels.
+type CoalesceConfig struct {
+	Channels *channelPattern
+	Window   time.Duration
+}
+
+// coalescer suppresses notifications which are identical to one received on
+// the same channel less than the configured window ago.  PostgreSQL already
+// does this within a single transaction; this extends it across transactions.
+type coalescer struct {
+	configs []CoalesceConfig
+	// the longest window in configs
+	maxWindow time.Duration
+
+	lock      sync.Mutex
+	seen      map[coalesceKey]time.Time
+	lastPrune time.Time
+}
+
+type coalesceKey struct {
+	channel string
+	payload string
+}
+
+func newCoalescer(configs []CoalesceConfig) *coalescer {
+	c := &coalescer{
+		configs: configs,
+		seen:    make(map[coalesceKey]time.Time),
+	}
+	for _, cfg := range configs {
+		if cfg.Window > c.maxWindow {
+			c.maxWindow = cfg.Window
+		}
+	}
+	return c
+}
+
+// Returns the window of the first configuration matching channel, or zero.
+func (c *coalescer) window(channel string) time.Duration {
+	for _, cfg := range c.configs {
+		if cfg.Channels.Match(channel) {
+			return cfg.Window
+		}
+	}
+	return 0
+}
+
+// Returns true if n should be suppressed as a duplicate.  Otherwise n starts a
+// new window for its channel and payload.
+func (c *coalescer) Suppress(n *notification) bool {
+	window := c.window(n.Channel)
+	if window == 0 {
+		return false
+	}
+
+	now := time.Now()
+	key := coalesceKey{n.Channel, n.Extra}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if first, ok := c.seen[key]; ok && now.Sub(first) < window {
+		return true
+	}
+	c.seen[key] = now
+
+	if now.Sub(c.lastPrune) >= c.maxWindow {
+		for k, first := range c.seen {
+			if now.Sub(first) >= c.maxWindow {
+				delete(c.seen, k)
+			}
+		}
+		c.lastPrune = now
+	}
+	return false
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"github.com/lib/pq"
+
+	"testing"
+	"time"
+)
+
+func TestCoalescer(t *testing.T) {
+	c := newCoalescer([]CoalesceConfig{
+		{newGlobPattern("cache_*"), 50 * time.Millisecond},
+	})
+	notification := func(channel, payload string) *notification {
+		return newNotification(&pq.Notification{Channel: channel, Extra: payload})
+	}
+
+	var tests = []struct {
+		channel  string
+		payload  string
+		suppress bool
+	}{
+		{"cache_users", "1", false},
+		{"cache_users", "1", true},
+		{"cache_users", "2", false},
+		{"cache_groups", "1", false},
+		{"orders", "1", false},
+		{"orders", "1", false},
+	}
+	for i, ts := range tests {
+		if c.Suppress(notification(ts.channel, ts.payload)) != ts.suppress {
+			t.Errorf("test %d: expected suppress to be %v", i, ts.suppress)
+		}
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if c.Suppress(notification("cache_users", "1")) {
+		t.Errorf("notification suppressed after the window had passed")
+	}
+}
@@ -6,6 +6,9 @@ import (
 	"math"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 type config struct {
@@ -14,27 +17,125 @@ type config struct {
 	ClientConnInfo string
 
 	StartupParameters map[string]string
+	ForwardServerParameters bool
+	ProducerTimestampField string
 	Databases VirtualDatabaseConfiguration
 
+	Upstream UpstreamConfig
+
+	Delivery DeliveryConfig
+
+	Replay []ReplayConfig
+
+	Coalesce []CoalesceConfig
+
+	Transformers []TransformerConfig
+
+	PayloadFetch []PayloadFetchConfig
+
+	DurableLog DurableLogConfig
+
+	Admin AdminConfig
+
+	HTTPAPI HTTPAPIConfig
+
+	Readiness ReadinessConfig
+
+	Metrics MetricsConfig
+
+	Log LogConfig
+
+	AuditLog AuditLogConfig
+
+	Tracing TracingConfig
+
+	Debug DebugConfig
+
 	Prometheus PrometheusConfig
 }
 
-var Config = config{
-	// These are the defaults
-
+// These are the defaults
+var defaultConfig = config{
 	Listen:	ListenConfig{6433, "localhost", true},
 
 	ClientConnInfo: "host=localhost port=5432 sslmode=disable",
 
 	StartupParameters: nil,
+	ForwardServerParameters: false,
 	Databases: nil,
 
+	Upstream: UpstreamConfig{
+		MinReconnectInterval: 250 * time.Millisecond,
+		MaxReconnectInterval: 3 * time.Second,
+		ReconnectJitter: 0.0,
+		PingInterval: 60 * time.Second,
+		PingTimeout: 0,
+		TCPKeepAliveInterval: 0,
+		TCPUserTimeout: 0,
+	},
+
+	Delivery: DeliveryConfig{
+		MaxBatchSize: 128,
+		MaxBatchLatency: 0,
+	},
+
+	DurableLog: DurableLogConfig{
+		Enabled: false,
+		SegmentSize: 64 * 1024 * 1024,
+		RetentionSize: 0,
+		RetentionAge: 0,
+		SyncPolicy: SyncAlways,
+		SyncInterval: time.Second,
+	},
+
+	Readiness: ReadinessConfig{
+		Enabled: false,
+		Channel: "allas_readiness",
+		Timeout: 5 * time.Second,
+	},
+
+	Log: LogConfig{
+		MinLevel: LOG,
+		Format: LogFormatText,
+		Destination: "stderr",
+		LogConnections: false,
+		LogDisconnections: true,
+		LogListens: false,
+	},
+
+	Tracing: TracingConfig{
+		Enabled: false,
+		Exporter: "otlp",
+		Endpoint: "localhost:4318",
+		Insecure: true,
+		SampleRatio: 1.0,
+		ServiceName: "allas",
+	},
+
+	AuditLog: AuditLogConfig{
+		Enabled: false,
+		SyncPolicy: SyncAlways,
+		SyncInterval: time.Second,
+	},
+
+	Metrics: MetricsConfig{
+		Enabled: false,
+		MaxChannels: 100,
+	},
+
 	Prometheus: PrometheusConfig{
 		Enabled: false,
 		Listen: ListenConfig{},
 	},
 }
 
+var Config = defaultConfig
+
+// Protects the parts of Config which are replaced by reloadConfigFile:
+// StartupParameters, Databases, Delivery and Admin.  Everything else is only
+// read once during startup.
+var configLock sync.RWMutex
+
 func readIntValue(dst *int, val interface{}, option string) error {
 	var err error
 
@@ -56,6 +157,43 @@ func readIntValue(dst *int, val interface{}, option string) error {
 	return nil
 }
 
+func readFloatValue(dst *float64, val interface{}, option string) error {
+	var err error
+
+	switch val := val.(type) {
+	case float64:
+		*dst = val
+	case string:
+		*dst, err = strconv.ParseFloat(val, 64)
+	default:
+		err = fmt.Errorf("input must be a number")
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value for option %q: %s", option, err.Error())
+	}
+	return nil
+}
+
+// Durations are specified as strings accepted by time.ParseDuration, e.g.
+// "250ms" or "1m30s".
+func readDurationValue(dst *time.Duration, val interface{}, option string) error {
+	var err error
+
+	switch val := val.(type) {
+	case string:
+		*dst, err = time.ParseDuration(val)
+		if err == nil && *dst < 0 {
+			err = fmt.Errorf("duration must not be negative")
+		}
+	default:
+		err = fmt.Errorf("input must be a duration string")
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value for option %q: %s", option, err.Error())
+	}
+	return nil
+}
+
 func readTextValue(dst *string, val interface{}, option string) error {
 	var err error
 
@@ -72,6 +210,36 @@ func readTextValue(dst *string, val interface{}, option string) error {
 	return nil
 }
 
+func readTextArrayValue(dst *[]string, val interface{}, option string) error {
+	array, ok := val.([]interface{})
+	if !ok {
+		return fmt.Errorf("invalid value for option %q: input must be an array of text strings", option)
+	}
+	*dst = nil
+	for i, el := range array {
+		var s string
+		err := readTextValue(&s, el, fmt.Sprintf("%s[%d]", option, i))
+		if err != nil {
+			return err
+		}
+		*dst = append(*dst, s)
+	}
+	return nil
+}
+
+func readGlobArrayValue(dst *[]*channelPattern, val interface{}, option string) error {
+	var globs []string
+	err := readTextArrayValue(&globs, val, option)
+	if err != nil {
+		return err
+	}
+	*dst = nil
+	for _, glob := range globs {
+		*dst = append(*dst, newGlobPattern(glob))
+	}
+	return nil
+}
+
 func readBooleanValue(dst *bool, val interface{}, option string) error {
 	var err error
 
@@ -185,7 +353,11 @@ func readDatabaseSection(c *config, val interface{}) error {
 		}
 
 		option := fmt.Sprintf("databases[%d]", dbindex)
-		var db virtualDatabase
+		db := virtualDatabase{
+			slowClientPolicy: SlowClientTerminate,
+			slowClientTimeout: 5 * time.Second,
+			queueDepth: 256,
+		}
 
 		for key, value := range data {
 			var err error
@@ -195,6 +367,27 @@ func readDatabaseSection(c *config, val interface{}) error {
 				err = readTextValue(&db.name, value, option+".name")
 			case "auth":
 				err = readAuthSection(&db.auth, value, option+".auth")
+			case "slow_client_policy":
+				var policy string
+				err = readTextValue(&policy, value, option+".slow_client_policy")
+				if err == nil {
+					db.slowClientPolicy, err = ParseSlowClientPolicy(policy)
+				}
+			case "slow_client_timeout":
+				err = readDurationValue(&db.slowClientTimeout, value, option+".slow_client_timeout")
+			case "queue_depth":
+				err = readIntValue(&db.queueDepth, value, option+".queue_depth")
+			case "max_channels_per_client":
+				err = readIntValue(&db.maxChannelsPerClient, value, option+".max_channels_per_client")
+			case "channel_prefix":
+				err = readTextValue(&db.channelPrefix, value, option+".channel_prefix")
+			case "allowed_channels":
+				err = readGlobArrayValue(&db.channelACL.allowed, value, option+".allowed_channels")
+			case "denied_channels":
+				err = readGlobArrayValue(&db.channelACL.denied, value, option+".denied_channels")
+			case "rate_limit":
+				db.rateLimit = &RateLimitConfig{}
+				err = readRateLimitSection(db.rateLimit, value, option+".rate_limit")
 			default:
 				err = fmt.Errorf("unrecognized configuration option %q", option+"."+key)
 			}
@@ -203,80 +396,917 @@ func readDatabaseSection(c *config, val interface{}) error {
 			}
 		}
 
+		if db.queueDepth < 1 {
+			return fmt.Errorf("%s.queue_depth must be at least 1", option)
+		}
+		if db.maxChannelsPerClient < 0 {
+			return fmt.Errorf("%s.max_channels_per_client must not be negative", option)
+		}
+
 		for _, pedb := range c.Databases {
 			if pedb.name == db.name {
 				return fmt.Errorf("database name %q is not unique", db.name)
 			}
+			// channels of databases with overlapping prefixes would not be
+			// isolated from each other
+			if pedb.channelPrefix != "" && db.channelPrefix != "" &&
+				(strings.HasPrefix(pedb.channelPrefix, db.channelPrefix) ||
+					strings.HasPrefix(db.channelPrefix, pedb.channelPrefix)) {
+				return fmt.Errorf("channel prefix %q of database %q overlaps with channel prefix %q of database %q",
+					db.channelPrefix, db.name, pedb.channelPrefix, pedb.name)
+			}
 		}
 		c.Databases = append(c.Databases, db)
 	}
 
+	// If some databases have a channel prefix, a database without one would
+	// see all of their channels.
+	for i := range c.Databases {
+		for j := range c.Databases {
+			if i == j || c.Databases[j].channelPrefix == "" {
+				continue
+			}
+			if c.Databases[i].channelPrefix == "" {
+				return fmt.Errorf("database %q must have a channel prefix because database %q has one",
+					c.Databases[i].name, c.Databases[j].name)
+			}
+			c.Databases[i].foreignPrefixes = append(c.Databases[i].foreignPrefixes, c.Databases[j].channelPrefix)
+		}
+	}
+
 	return nil
 }
 
-func readPrometheusSection(c *config, val interface{}) error {
+func readUpstreamSection(c *UpstreamConfig, val interface{}, option string) error {
 	data, ok := val.(map[string]interface{})
 	if !ok {
-		return fmt.Errorf(`section "prometheus" must be a JSON object`)
+		return fmt.Errorf(`section %q must be a JSON object`, option)
 	}
 	for key, value := range data {
 		var err error
 
 		switch key {
-		case "listen":
-			err = readListenSection(&c.Prometheus.Listen, value, "prometheus.listen")
+		case "min_reconnect_interval":
+			err = readDurationValue(&c.MinReconnectInterval, value, option+".min_reconnect_interval")
+		case "max_reconnect_interval":
+			err = readDurationValue(&c.MaxReconnectInterval, value, option+".max_reconnect_interval")
+		case "reconnect_jitter":
+			err = readFloatValue(&c.ReconnectJitter, value, option+".reconnect_jitter")
+		case "ping_interval":
+			err = readDurationValue(&c.PingInterval, value, option+".ping_interval")
+		case "ping_timeout":
+			err = readDurationValue(&c.PingTimeout, value, option+".ping_timeout")
+		case "tcp_keepalive_interval":
+			err = readDurationValue(&c.TCPKeepAliveInterval, value, option+".tcp_keepalive_interval")
+		case "tcp_user_timeout":
+			err = readDurationValue(&c.TCPUserTimeout, value, option+".tcp_user_timeout")
+		case "channels":
+			err = readTextArrayValue(&c.Channels, value, option+".channels")
+		case "max_upstream_channels":
+			err = readIntValue(&c.MaxChannels, value, option+".max_upstream_channels")
 		default:
-			err = fmt.Errorf("unrecognized configuration option %q", "prometheus." + key)
+			err = fmt.Errorf("unrecognized configuration option %q", option+"."+key)
 		}
 		if err != nil {
 			return err
 		}
 	}
-	c.Prometheus.Enabled = true
+
+	if c.MinReconnectInterval <= 0 {
+		return fmt.Errorf("%s.min_reconnect_interval must be greater than zero", option)
+	}
+	if c.MaxReconnectInterval < c.MinReconnectInterval {
+		return fmt.Errorf("%s.max_reconnect_interval must not be less than %s.min_reconnect_interval", option, option)
+	}
+	if c.ReconnectJitter < 0 || c.ReconnectJitter > 1 {
+		return fmt.Errorf("%s.reconnect_jitter must be between 0 and 1", option)
+	}
+	if c.PingInterval <= 0 {
+		return fmt.Errorf("%s.ping_interval must be greater than zero", option)
+	}
+	if c.TCPUserTimeout > 0 && !tcpUserTimeoutSupported {
+		return fmt.Errorf("%s.tcp_user_timeout is not supported on this platform", option)
+	}
+	if c.MaxChannels < 0 {
+		return fmt.Errorf("%s.max_upstream_channels must not be negative", option)
+	} else if c.MaxChannels > 0 && len(c.Channels) > c.MaxChannels {
+		return fmt.Errorf("%s.channels has more than %s.max_upstream_channels entries", option, option)
+	}
 	return nil
 }
 
+func readDeliverySection(c *DeliveryConfig, val interface{}, option string) error {
+	data, ok := val.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf(`section %q must be a JSON object`, option)
+	}
+	for key, value := range data {
+		var err error
 
-func readConfigFile(filename string) error {
-	var ci interface{}
-
-	fh, err := os.Open(filename)
-	if err != nil {
-		return err
+		switch key {
+		case "max_batch_size":
+			err = readIntValue(&c.MaxBatchSize, value, option+".max_batch_size")
+		case "max_batch_latency":
+			err = readDurationValue(&c.MaxBatchLatency, value, option+".max_batch_latency")
+		case "rate_limits":
+			err = readChannelRateLimits(&c.RateLimits, value, option+".rate_limits")
+		default:
+			err = fmt.Errorf("unrecognized configuration option %q", option+"."+key)
+		}
+		if err != nil {
+			return err
+		}
 	}
-	defer fh.Close()
-	dec := json.NewDecoder(fh)
-	err = dec.Decode(&ci)
-	if err != nil {
-		return err
+
+	if c.MaxBatchSize < 1 {
+		return fmt.Errorf("%s.max_batch_size must be at least 1", option)
 	}
+	return nil
+}
 
-	sections, ok := ci.(map[string]interface{})
+func readChannelRateLimits(dst *[]ChannelRateLimitConfig, val interface{}, option string) error {
+	array, ok := val.([]interface{})
 	if !ok {
-		return fmt.Errorf("configuration must be a JSON object")
+		return fmt.Errorf("option %q must be a JSON array", option)
 	}
 
-	for key, value := range sections {
+	for index, el := range array {
+		data, ok := el.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("elements within the %q array must be JSON objects", option)
+		}
+
+		elOption := fmt.Sprintf("%s[%d]", option, index)
+		channels, hasChannels := data["channels"]
+		if !hasChannels {
+			return fmt.Errorf("%s.channels must be specified", elOption)
+		}
+		var pattern string
+		err := readTextValue(&pattern, channels, elOption+".channels")
+		if err != nil {
+			return err
+		}
+		delete(data, "channels")
+
+		rl := ChannelRateLimitConfig{Channels: newGlobPattern(pattern)}
+		err = readRateLimitSection(&rl.RateLimitConfig, data, elOption)
+		if err != nil {
+			return err
+		}
+		*dst = append(*dst, rl)
+	}
+	return nil
+}
+
+func readRateLimitSection(c *RateLimitConfig, val interface{}, option string) error {
+	data, ok := val.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("option %q must be a JSON object", option)
+	}
+	c.Action = RateLimitDrop
+	for key, value := range data {
 		var err error
 
 		switch key {
-		case "listen":
-			err = readListenSection(&Config.Listen, value, "listen")
-		case "connect":
-			err = readConnectSection(&Config, value)
-		case "startup_parameters":
-			err = readStartupParameterSection(&Config, value)
-		case "databases":
-			err = readDatabaseSection(&Config, value)
-		case "prometheus":
-			err = readPrometheusSection(&Config, value)
+		case "rate":
+			err = readFloatValue(&c.Rate, value, option+".rate")
+		case "burst":
+			err = readIntValue(&c.Burst, value, option+".burst")
+		case "action":
+			var action string
+			err = readTextValue(&action, value, option+".action")
+			if err == nil {
+				c.Action, err = ParseRateLimitAction(action)
+			}
 		default:
-			err = fmt.Errorf("unrecognized configuration section %q", key)
+			err = fmt.Errorf("unrecognized configuration option %q", option+"."+key)
 		}
 		if err != nil {
 			return err
 		}
 	}
 
+	if c.Rate <= 0 {
+		return fmt.Errorf("%s.rate must be greater than zero", option)
+	}
+	if c.Burst == 0 {
+		c.Burst = int(math.Max(1, math.Ceil(c.Rate)))
+	} else if c.Burst < 1 {
+		return fmt.Errorf("%s.burst must be at least 1", option)
+	}
+	return nil
+}
+
+func readReplaySection(c *config, val interface{}) error {
+	array, ok := val.([]interface{})
+	if !ok {
+		return fmt.Errorf(`section "replay" must be a JSON array`)
+	}
+
+	for index, el := range array {
+		data, ok := el.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf(`elements within the "replay" array must be JSON objects`)
+		}
+
+		option := fmt.Sprintf("replay[%d]", index)
+		rc := ReplayConfig{
+			MaxCount: 1000,
+			MaxAge: 0,
+		}
+
+		for key, value := range data {
+			var err error
+
+			switch key {
+			case "prefix":
+				err = readTextValue(&rc.Prefix, value, option+".prefix")
+			case "max_count":
+				err = readIntValue(&rc.MaxCount, value, option+".max_count")
+			case "max_age":
+				err = readDurationValue(&rc.MaxAge, value, option+".max_age")
+			default:
+				err = fmt.Errorf("unrecognized configuration option %q", option+"."+key)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		if rc.MaxCount < 1 {
+			return fmt.Errorf("%s.max_count must be at least 1", option)
+		}
+		for _, prc := range c.Replay {
+			if prc.Prefix == rc.Prefix {
+				return fmt.Errorf("replay prefix %q is not unique", rc.Prefix)
+			}
+		}
+		c.Replay = append(c.Replay, rc)
+	}
+
+	return nil
+}
+
+func readCoalesceSection(c *config, val interface{}) error {
+	array, ok := val.([]interface{})
+	if !ok {
+		return fmt.Errorf(`section "coalesce" must be a JSON array`)
+	}
+
+	for index, el := range array {
+		data, ok := el.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf(`elements within the "coalesce" array must be JSON objects`)
+		}
+
+		option := fmt.Sprintf("coalesce[%d]", index)
+		var channels string
+		var cc CoalesceConfig
+
+		for key, value := range data {
+			var err error
+
+			switch key {
+			case "channels":
+				err = readTextValue(&channels, value, option+".channels")
+			case "window":
+				err = readDurationValue(&cc.Window, value, option+".window")
+			default:
+				err = fmt.Errorf("unrecognized configuration option %q", option+"."+key)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		if channels == "" {
+			return fmt.Errorf("%s.channels must be specified", option)
+		}
+		if cc.Window <= 0 {
+			return fmt.Errorf("%s.window must be greater than zero", option)
+		}
+		cc.Channels = newGlobPattern(channels)
+		c.Coalesce = append(c.Coalesce, cc)
+	}
+
 	return nil
 }
+
+func readTransformersSection(c *config, val interface{}) error {
+	array, ok := val.([]interface{})
+	if !ok {
+		return fmt.Errorf(`section "transformers" must be a JSON array`)
+	}
+
+	for index, el := range array {
+		data, ok := el.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf(`elements within the "transformers" array must be JSON objects`)
+		}
+
+		option := fmt.Sprintf("transformers[%d]", index)
+		var channels string
+		var tc TransformerConfig
+		options := make(map[string]interface{})
+
+		for key, value := range data {
+			var err error
+
+			switch key {
+			case "channels":
+				err = readTextValue(&channels, value, option+".channels")
+			case "type":
+				err = readTextValue(&tc.Name, value, option+".type")
+			default:
+				// passed on to the transformer
+				options[key] = value
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		if channels == "" {
+			return fmt.Errorf("%s.channels must be specified", option)
+		}
+		if tc.Name == "" {
+			return fmt.Errorf("%s.type must be specified", option)
+		}
+		var err error
+		tc.Transformer, err = newTransformer(tc.Name, options)
+		if err != nil {
+			return fmt.Errorf("%s: %s", option, err)
+		}
+		tc.Channels = newGlobPattern(channels)
+		c.Transformers = append(c.Transformers, tc)
+	}
+
+	return nil
+}
+
+func readPayloadFetchSection(c *config, val interface{}) error {
+	array, ok := val.([]interface{})
+	if !ok {
+		return fmt.Errorf(`section "payload_fetch" must be a JSON array`)
+	}
+
+	for index, el := range array {
+		data, ok := el.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf(`elements within the "payload_fetch" array must be JSON objects`)
+		}
+
+		option := fmt.Sprintf("payload_fetch[%d]", index)
+		var channels string
+		pf := PayloadFetchConfig{
+			Timeout: 5 * time.Second,
+			CacheSize: 1000,
+			CacheTTL: time.Minute,
+		}
+
+		for key, value := range data {
+			var err error
+
+			switch key {
+			case "channels":
+				err = readTextValue(&channels, value, option+".channels")
+			case "reference_prefix":
+				err = readTextValue(&pf.ReferencePrefix, value, option+".reference_prefix")
+			case "query":
+				err = readTextValue(&pf.Query, value, option+".query")
+			case "timeout":
+				err = readDurationValue(&pf.Timeout, value, option+".timeout")
+			case "cache_size":
+				err = readIntValue(&pf.CacheSize, value, option+".cache_size")
+			case "cache_ttl":
+				err = readDurationValue(&pf.CacheTTL, value, option+".cache_ttl")
+			default:
+				err = fmt.Errorf("unrecognized configuration option %q", option+"."+key)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		if channels == "" {
+			return fmt.Errorf("%s.channels must be specified", option)
+		}
+		if pf.Query == "" {
+			return fmt.Errorf("%s.query must be specified", option)
+		}
+		if pf.Timeout <= 0 {
+			return fmt.Errorf("%s.timeout must be greater than zero", option)
+		}
+		if pf.CacheSize < 0 {
+			return fmt.Errorf("%s.cache_size must not be negative", option)
+		}
+		pf.Channels = newGlobPattern(channels)
+		c.PayloadFetch = append(c.PayloadFetch, pf)
+	}
+
+	return nil
+}
+
+func readDurableLogSection(c *DurableLogConfig, val interface{}, option string) error {
+	data, ok := val.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf(`section %q must be a JSON object`, option)
+	}
+	for key, value := range data {
+		var err error
+		var intValue int
+
+		switch key {
+		case "directory":
+			err = readTextValue(&c.Directory, value, option+".directory")
+		case "segment_size":
+			err = readIntValue(&intValue, value, option+".segment_size")
+			c.SegmentSize = int64(intValue)
+		case "retention_size":
+			err = readIntValue(&intValue, value, option+".retention_size")
+			c.RetentionSize = int64(intValue)
+		case "retention_age":
+			err = readDurationValue(&c.RetentionAge, value, option+".retention_age")
+		case "sync":
+			var policy string
+			err = readTextValue(&policy, value, option+".sync")
+			if err == nil {
+				c.SyncPolicy, err = ParseSyncPolicy(policy)
+			}
+		case "sync_interval":
+			err = readDurationValue(&c.SyncInterval, value, option+".sync_interval")
+		default:
+			err = fmt.Errorf("unrecognized configuration option %q", option+"."+key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.Directory == "" {
+		return fmt.Errorf("%s.directory must be specified", option)
+	}
+	if c.SegmentSize < 1 {
+		return fmt.Errorf("%s.segment_size must be at least 1", option)
+	}
+	if c.SyncInterval <= 0 {
+		return fmt.Errorf("%s.sync_interval must be positive", option)
+	}
+	c.Enabled = true
+	return nil
+}
+
+func readAdminSection(c *AdminConfig, val interface{}, option string) error {
+	data, ok := val.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf(`section %q must be a JSON object`, option)
+	}
+	c.Database = "allas"
+	for key, value := range data {
+		var err error
+
+		switch key {
+		case "database":
+			err = readTextValue(&c.Database, value, option+".database")
+		case "users":
+			array, ok := value.([]interface{})
+			if !ok {
+				return fmt.Errorf(`section %q must be a JSON array`, option+".users")
+			}
+			for index, el := range array {
+				var auth AuthConfig
+				err = readAuthSection(&auth, el, fmt.Sprintf("%s.users[%d]", option, index))
+				if err != nil {
+					return err
+				}
+				if auth.user == "" {
+					return fmt.Errorf("%s.users[%d].user must be specified", option, index)
+				}
+				c.Users = append(c.Users, auth)
+			}
+		default:
+			err = fmt.Errorf("unrecognized configuration option %q", option+"."+key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.Database == "" {
+		return fmt.Errorf("%s.database must not be empty", option)
+	}
+	if len(c.Users) == 0 {
+		return fmt.Errorf("at least one user must be specified in %s.users", option)
+	}
+	return nil
+}
+
+// Adds the admin console database to c.Databases.  Must be called after all
+// sections have been read.
+func addAdminDatabase(c *config) error {
+	if c.Admin.Database == "" {
+		return nil
+	}
+	if c.Databases.find(c.Admin.Database) != nil {
+		return fmt.Errorf("admin database name %q conflicts with a database in \"databases\"", c.Admin.Database)
+	}
+	c.Databases = append(c.Databases, virtualDatabase{
+		name: c.Admin.Database,
+		slowClientPolicy: SlowClientTerminate,
+		slowClientTimeout: 5 * time.Second,
+		queueDepth: 256,
+		admin: true,
+		adminUsers: c.Admin.Users,
+	})
+	return nil
+}
+
+func readHTTPAPISection(c *HTTPAPIConfig, val interface{}, option string) error {
+	data, ok := val.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf(`section %q must be a JSON object`, option)
+	}
+	for key, value := range data {
+		var err error
+
+		switch key {
+		case "listen":
+			err = readListenSection(&c.Listen, value, option+".listen")
+		case "token":
+			err = readTextValue(&c.Token, value, option+".token")
+		default:
+			err = fmt.Errorf("unrecognized configuration option %q", option+"."+key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.Listen.Host == "" {
+		return fmt.Errorf("%s.listen.host must be specified", option)
+	}
+	if c.Token == "" {
+		return fmt.Errorf("%s.token must be specified", option)
+	}
+	c.Enabled = true
+	return nil
+}
+
+func readDebugSection(c *DebugConfig, val interface{}, option string) error {
+	data, ok := val.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf(`section %q must be a JSON object`, option)
+	}
+	for key, value := range data {
+		var err error
+
+		switch key {
+		case "listen":
+			err = readListenSection(&c.Listen, value, option+".listen")
+		default:
+			err = fmt.Errorf("unrecognized configuration option %q", option+"."+key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.Listen.Host == "" {
+		return fmt.Errorf("%s.listen.host must be specified", option)
+	}
+	c.Enabled = true
+	return nil
+}
+
+func readReadinessSection(c *ReadinessConfig, val interface{}, option string) error {
+	data, ok := val.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf(`section %q must be a JSON object`, option)
+	}
+	for key, value := range data {
+		var err error
+
+		switch key {
+		case "notify_channel":
+			err = readTextValue(&c.Channel, value, option+".notify_channel")
+		case "timeout":
+			err = readDurationValue(&c.Timeout, value, option+".timeout")
+		default:
+			err = fmt.Errorf("unrecognized configuration option %q", option+"."+key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.Channel == "" {
+		return fmt.Errorf("%s.notify_channel must not be empty", option)
+	}
+	if c.Timeout <= 0 {
+		return fmt.Errorf("%s.timeout must be positive", option)
+	}
+	c.Enabled = true
+	return nil
+}
+
+func readMetricsSection(c *MetricsConfig, val interface{}, option string) error {
+	data, ok := val.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf(`section %q must be a JSON object`, option)
+	}
+	for key, value := range data {
+		var err error
+
+		switch key {
+		case "channels":
+			err = readGlobArrayValue(&c.Channels, value, option+".channels")
+			if err == nil && c.Channels == nil {
+				c.Channels = []*channelPattern{}
+			}
+		case "max_channels":
+			err = readIntValue(&c.MaxChannels, value, option+".max_channels")
+		default:
+			err = fmt.Errorf("unrecognized configuration option %q", option+"."+key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.MaxChannels < 0 {
+		return fmt.Errorf("%s.max_channels must not be negative", option)
+	}
+	c.Enabled = true
+	return nil
+}
+
+func readLogSection(c *LogConfig, val interface{}, option string) error {
+	data, ok := val.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf(`section %q must be a JSON object`, option)
+	}
+	for key, value := range data {
+		var err error
+		var text string
+		var intValue int
+
+		switch key {
+		case "level":
+			err = readTextValue(&text, value, option+".level")
+			if err == nil {
+				c.MinLevel, err = ParseLogSeverity(text)
+			}
+		case "format":
+			err = readTextValue(&text, value, option+".format")
+			if err == nil {
+				c.Format, err = ParseLogFormat(text)
+			}
+		case "destination":
+			err = readTextValue(&c.Destination, value, option+".destination")
+		case "file":
+			err = readTextValue(&c.File, value, option+".file")
+		case "rotation_size":
+			err = readIntValue(&intValue, value, option+".rotation_size")
+			c.RotationSize = int64(intValue)
+		case "rotation_age":
+			err = readDurationValue(&c.RotationAge, value, option+".rotation_age")
+		case "log_connections":
+			err = readBooleanValue(&c.LogConnections, value, option+".log_connections")
+		case "log_disconnections":
+			err = readBooleanValue(&c.LogDisconnections, value, option+".log_disconnections")
+		case "log_listens":
+			err = readBooleanValue(&c.LogListens, value, option+".log_listens")
+		default:
+			err = fmt.Errorf("unrecognized configuration option %q", option+"."+key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	switch c.Destination {
+	case "stderr", "syslog":
+	case "file":
+		if c.File == "" {
+			return fmt.Errorf("%s.file must be specified when %s.destination is \"file\"", option, option)
+		}
+	default:
+		return fmt.Errorf("invalid value %q for option %q", c.Destination, option+".destination")
+	}
+	if c.RotationSize < 0 {
+		return fmt.Errorf("%s.rotation_size must not be negative", option)
+	}
+	return nil
+}
+
+func readAuditLogSection(c *AuditLogConfig, val interface{}, option string) error {
+	data, ok := val.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf(`section %q must be a JSON object`, option)
+	}
+	for key, value := range data {
+		var err error
+
+		switch key {
+		case "file":
+			err = readTextValue(&c.File, value, option+".file")
+		case "sync":
+			var policy string
+			err = readTextValue(&policy, value, option+".sync")
+			if err == nil {
+				c.SyncPolicy, err = ParseSyncPolicy(policy)
+			}
+		case "sync_interval":
+			err = readDurationValue(&c.SyncInterval, value, option+".sync_interval")
+		default:
+			err = fmt.Errorf("unrecognized configuration option %q", option+"."+key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.File == "" {
+		return fmt.Errorf("%s.file must be specified", option)
+	}
+	if c.SyncInterval <= 0 {
+		return fmt.Errorf("%s.sync_interval must be positive", option)
+	}
+	c.Enabled = true
+	return nil
+}
+
+func readTracingSection(c *TracingConfig, val interface{}, option string) error {
+	data, ok := val.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf(`section %q must be a JSON object`, option)
+	}
+	for key, value := range data {
+		var err error
+
+		switch key {
+		case "exporter":
+			err = readTextValue(&c.Exporter, value, option+".exporter")
+		case "endpoint":
+			err = readTextValue(&c.Endpoint, value, option+".endpoint")
+		case "insecure":
+			err = readBooleanValue(&c.Insecure, value, option+".insecure")
+		case "file":
+			err = readTextValue(&c.File, value, option+".file")
+		case "sample_ratio":
+			err = readFloatValue(&c.SampleRatio, value, option+".sample_ratio")
+		case "service_name":
+			err = readTextValue(&c.ServiceName, value, option+".service_name")
+		default:
+			err = fmt.Errorf("unrecognized configuration option %q", option+"."+key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	switch c.Exporter {
+	case "otlp":
+		if c.Endpoint == "" {
+			return fmt.Errorf("%s.endpoint must not be empty", option)
+		}
+	case "file":
+		if c.File == "" {
+			return fmt.Errorf("%s.file must be specified when %s.exporter is \"file\"", option, option)
+		}
+	default:
+		return fmt.Errorf("invalid value %q for option %q", c.Exporter, option+".exporter")
+	}
+	if c.SampleRatio < 0 || c.SampleRatio > 1 {
+		return fmt.Errorf("%s.sample_ratio must be between 0 and 1", option)
+	}
+	c.Enabled = true
+	return nil
+}
+
+func readPrometheusSection(c *config, val interface{}) error {
+	data, ok := val.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf(`section "prometheus" must be a JSON object`)
+	}
+	for key, value := range data {
+		var err error
+
+		switch key {
+		case "listen":
+			err = readListenSection(&c.Prometheus.Listen, value, "prometheus.listen")
+		default:
+			err = fmt.Errorf("unrecognized configuration option %q", "prometheus." + key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	c.Prometheus.Enabled = true
+	return nil
+}
+
+
+func readConfigFile(filename string) error {
+	return readConfig(filename, &Config)
+}
+
+// Reads the configuration file again, and applies the changes to the
+// sections which can be changed without a restart.  Clients which are
+// already connected keep using the old configuration.
+func reloadConfigFile(filename string) error {
+	c := defaultConfig
+	err := readConfig(filename, &c)
+	if err != nil {
+		return err
+	}
+
+	configLock.Lock()
+	defer configLock.Unlock()
+	Config.StartupParameters = c.StartupParameters
+	Config.Databases = c.Databases
+	Config.Delivery = c.Delivery
+	Config.Admin = c.Admin
+	return nil
+}
+
+func readConfig(filename string, c *config) error {
+	var ci interface{}
+
+	fh, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	dec := json.NewDecoder(fh)
+	err = dec.Decode(&ci)
+	if err != nil {
+		return err
+	}
+
+	sections, ok := ci.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("configuration must be a JSON object")
+	}
+
+	for key, value := range sections {
+		var err error
+
+		switch key {
+		case "listen":
+			err = readListenSection(&c.Listen, value, "listen")
+		case "connect":
+			err = readConnectSection(c, value)
+		case "startup_parameters":
+			err = readStartupParameterSection(c, value)
+		case "forward_server_parameters":
+			err = readBooleanValue(&c.ForwardServerParameters, value, "forward_server_parameters")
+		case "producer_timestamp_field":
+			err = readTextValue(&c.ProducerTimestampField, value, "producer_timestamp_field")
+		case "databases":
+			err = readDatabaseSection(c, value)
+		case "upstream":
+			err = readUpstreamSection(&c.Upstream, value, "upstream")
+		case "delivery":
+			err = readDeliverySection(&c.Delivery, value, "delivery")
+		case "replay":
+			err = readReplaySection(c, value)
+		case "coalesce":
+			err = readCoalesceSection(c, value)
+		case "transformers":
+			err = readTransformersSection(c, value)
+		case "payload_fetch":
+			err = readPayloadFetchSection(c, value)
+		case "durable_log":
+			err = readDurableLogSection(&c.DurableLog, value, "durable_log")
+		case "admin":
+			err = readAdminSection(&c.Admin, value, "admin")
+		case "http_api":
+			err = readHTTPAPISection(&c.HTTPAPI, value, "http_api")
+		case "readiness":
+			err = readReadinessSection(&c.Readiness, value, "readiness")
+		case "metrics":
+			err = readMetricsSection(&c.Metrics, value, "metrics")
+		case "log":
+			err = readLogSection(&c.Log, value, "log")
+		case "audit_log":
+			err = readAuditLogSection(&c.AuditLog, value, "audit_log")
+		case "tracing":
+			err = readTracingSection(&c.Tracing, value, "tracing")
+		case "debug":
+			err = readDebugSection(&c.Debug, value, "debug")
+		case "prometheus":
+			err = readPrometheusSection(c, value)
+		default:
+			err = fmt.Errorf("unrecognized configuration section %q", key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(c.Databases) == 0 {
+		return fmt.Errorf("at least one database must be configured")
+	}
+	return addAdminDatabase(c)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+)
+
+// DebugConfig specifies the debug listener, which serves the net/http/pprof
+// endpoints.  It is not authenticated, so it should only be reachable by
+// operators.
+type DebugConfig struct {
+	Enabled bool
+	Listen  ListenConfig
+}
+
+// Returns the handler serving the profiling endpoints under /debug/pprof/.
+// Besides the named profiles served by the index (goroutine, heap, allocs,
+// block, mutex, threadcreate), the CPU profile, execution trace, command line
+// and symbol lookup are available.
+func newDebugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+func (cfg *DebugConfig) Setup() error {
+	s := &http.Server{
+		Handler: newDebugHandler(),
+	}
+	l, err := cfg.Listen.Listen()
+	if err != nil {
+		return err
+	}
+	go func() {
+		elog.Fatalf("debug HTTP endpoint failed: %s", s.Serve(l))
+	}()
+	return nil
+}
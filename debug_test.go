@@ -0,0 +1,41 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDebugHandler(t *testing.T) {
+	srv := httptest.NewServer(newDebugHandler())
+	defer srv.Close()
+
+	testCases := []struct {
+		path     string
+		contains string
+	}{
+		{"/debug/pprof/", "goroutine"},
+		{"/debug/pprof/goroutine?debug=2", "TestDebugHandler"},
+		{"/debug/pprof/heap?debug=1", "heap profile"},
+		{"/debug/pprof/cmdline", ""},
+	}
+	for _, tc := range testCases {
+		resp, err := http.Get(srv.URL + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: unexpected status %d", tc.path, resp.StatusCode)
+		}
+		if !strings.Contains(string(body), tc.contains) {
+			t.Errorf("%s: %q not found in the response", tc.path, tc.contains)
+		}
+	}
+}
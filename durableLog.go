@@ -0,0 +1,666 @@
+package main
+
+import (
+	"github.com/lib/pq"
+
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errNoDurableLog     = errors.New("durable notification log is not enabled")
+	errConsumerMismatch = errors.New("session is already attached to a different consumer")
+	errNoConsumer       = errors.New("session is not attached to a consumer")
+	errDurableLogClosed = errors.New("durable notification log has been closed")
+	errOffsetNotInLog   = errors.New("offset is past the end of the durable notification log")
+	errOffsetBackwards  = errors.New("offset is older than the one already acknowledged by the consumer")
+)
+
+type DurableLogConfig struct {
+	Enabled   bool
+	Directory string
+	// a new segment is started once the current one reaches this size
+	SegmentSize int64
+	// old segments are removed once the total size of the log exceeds this;
+	// zero means no limit
+	RetentionSize int64
+	// segments older than this are removed; zero means no limit
+	RetentionAge time.Duration
+	SyncPolicy   SyncPolicy
+	SyncInterval time.Duration
+}
+
+// Append waits for the writer goroutine once this many bytes of records are
+// waiting to be written, rather than using an unbounded amount of memory.
+const durableLogMaxPendingBytes = 16 * 1024 * 1024
+
+// durableLog is an append-only log of all notifications received from the
+// server, stored in segment files in a local directory.  Every record is
+// assigned an offset, which is increased by one for every record and never
+// reused.  Each segment file is named after the offset of its first record.
+//
+// Append only assigns the offset; the records are written to disk by a
+// separate goroutine, so that a slow disk doesn't hold up delivery.
+//
+// The log also remembers the last offset acknowledged by each named consumer,
+// so that consumers can resume where they left off after a restart of either
+// allas or the consumer itself.
+type durableLog struct {
+	cfg DurableLogConfig
+
+	lock sync.Mutex
+	// signalled when the writer has taken the pending records, and when it
+	// has written them
+	cond          *sync.Cond
+	segments      []logSegment
+	lastOffset    uint64
+	writtenOffset uint64
+	pending       []pendingLogRecord
+	pendingBytes  int
+	consumers     map[string]uint64
+	closed        bool
+
+	// wakes up the writer when there are pending records
+	wake    chan struct{}
+	stop    chan struct{}
+	stopped chan struct{}
+
+	// only used by the writer goroutine once openDurableLog has returned
+	file        *os.File
+	w           *bufio.Writer
+	segmentSize int64
+	dirty       bool
+}
+
+type logSegment struct {
+	firstOffset uint64
+	path        string
+}
+
+type pendingLogRecord struct {
+	offset uint64
+	data   []byte
+}
+
+// Each record is stored as the length of the body, a CRC-32 of the body and
+// the body itself.  The body consists of the offset, the time the
+// notification was received in nanoseconds since the epoch, the backend PID,
+// the length of the channel name, the channel name and the payload.
+const logRecordHeaderSize = 8
+const logRecordFixedBodySize = 8 + 8 + 8 + 4
+
+type logRecord struct {
+	offset   uint64
+	received time.Time
+	n        pq.Notification
+}
+
+func segmentPath(dir string, firstOffset uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d.log", firstOffset))
+}
+
+// Opens the log in cfg.Directory, creating it if necessary.  A partially
+// written record at the end of the last segment (e.g. because of a crash) is
+// removed.
+func openDurableLog(cfg DurableLogConfig) (*durableLog, error) {
+	err := os.MkdirAll(cfg.Directory, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &durableLog{
+		cfg:       cfg,
+		consumers: make(map[string]uint64),
+		wake:      make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	l.cond = sync.NewCond(&l.lock)
+
+	entries, err := os.ReadDir(cfg.Directory)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasSuffix(name, ".log") {
+			continue
+		}
+		firstOffset, err := strconv.ParseUint(strings.TrimSuffix(name, ".log"), 10, 64)
+		if err != nil {
+			continue
+		}
+		l.segments = append(l.segments, logSegment{firstOffset, filepath.Join(cfg.Directory, name)})
+	}
+	sort.Slice(l.segments, func(i, j int) bool {
+		return l.segments[i].firstOffset < l.segments[j].firstOffset
+	})
+
+	if len(l.segments) == 0 {
+		err = l.startSegment(1)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		last := l.segments[len(l.segments)-1]
+		l.lastOffset = last.firstOffset - 1
+		validSize := int64(0)
+		err = readLogSegment(last.path, 0, func(r *logRecord, endPos int64) bool {
+			l.lastOffset = r.offset
+			validSize = endPos
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		l.file, err = os.OpenFile(last.path, os.O_RDWR, 0600)
+		if err != nil {
+			return nil, err
+		}
+		err = l.file.Truncate(validSize)
+		if err != nil {
+			return nil, err
+		}
+		_, err = l.file.Seek(validSize, io.SeekStart)
+		if err != nil {
+			return nil, err
+		}
+		l.w = bufio.NewWriter(l.file)
+		l.segmentSize = validSize
+	}
+
+	err = l.readConsumers()
+	if err != nil {
+		return nil, err
+	}
+	// Records which hadn't been synced when allas crashed might have been
+	// acknowledged already; never hand out their offsets again.
+	for _, offset := range l.consumers {
+		if offset > l.lastOffset {
+			l.lastOffset = offset
+		}
+	}
+	l.writtenOffset = l.lastOffset
+
+	go l.writer()
+	return l, nil
+}
+
+// Starts a new segment, syncing and closing the current one.  The caller must
+// be the writer goroutine, or have exclusive access to l.
+func (l *durableLog) startSegment(firstOffset uint64) error {
+	path := segmentPath(l.cfg.Directory, firstOffset)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if l.file != nil {
+		if l.cfg.SyncPolicy != SyncNever {
+			err = l.file.Sync()
+			if err != nil {
+				elog.Errorf("could not fsync the durable log: %s", err)
+			}
+		}
+		_ = l.file.Close()
+	}
+	l.file = f
+	l.w = bufio.NewWriter(f)
+	l.segmentSize = 0
+	l.dirty = false
+
+	l.lock.Lock()
+	l.segments = append(l.segments, logSegment{firstOffset, path})
+	l.lock.Unlock()
+	return nil
+}
+
+// Appends n to the log and assigns it an offset.  The record is written to
+// disk in the background.
+func (l *durableLog) Append(n *notification) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for l.pendingBytes >= durableLogMaxPendingBytes && !l.closed {
+		l.cond.Wait()
+	}
+	if l.closed {
+		return errDurableLogClosed
+	}
+
+	offset := l.lastOffset + 1
+	data := encodeLogRecord(offset, n)
+	l.pending = append(l.pending, pendingLogRecord{offset, data})
+	l.pendingBytes += len(data)
+	l.lastOffset = offset
+	n.offset = offset
+	signal(l.wake)
+	return nil
+}
+
+func encodeLogRecord(offset uint64, n *notification) []byte {
+	data := make([]byte, logRecordHeaderSize+logRecordFixedBodySize, logRecordHeaderSize+logRecordFixedBodySize+len(n.Channel)+len(n.Extra))
+	body := data[logRecordHeaderSize:]
+	binary.BigEndian.PutUint64(body[0:], offset)
+	binary.BigEndian.PutUint64(body[8:], uint64(n.received.UnixNano()))
+	binary.BigEndian.PutUint64(body[16:], uint64(n.BePid))
+	binary.BigEndian.PutUint32(body[24:], uint32(len(n.Channel)))
+	data = append(data, n.Channel...)
+	data = append(data, n.Extra...)
+
+	body = data[logRecordHeaderSize:]
+	binary.BigEndian.PutUint32(data[0:], uint32(len(body)))
+	binary.BigEndian.PutUint32(data[4:], crc32.ChecksumIEEE(body))
+	return data
+}
+
+// Writes the pending records to disk, syncs the log according to the sync
+// policy and applies the retention settings until Close is called.
+func (l *durableLog) writer() {
+	defer close(l.stopped)
+
+	var syncTick, retentionTick <-chan time.Time
+	if l.cfg.SyncPolicy == SyncInterval {
+		ticker := time.NewTicker(l.cfg.SyncInterval)
+		defer ticker.Stop()
+		syncTick = ticker.C
+	}
+	if l.cfg.RetentionAge > 0 {
+		// expire old segments even if nothing is being appended
+		interval := min(l.cfg.RetentionAge, time.Minute)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		retentionTick = ticker.C
+	}
+
+	for {
+		select {
+		case <-l.wake:
+			l.writePending()
+		case <-syncTick:
+			l.sync()
+		case <-retentionTick:
+			l.applyRetention()
+		case <-l.stop:
+			l.writePending()
+			l.sync()
+			_ = l.file.Close()
+			return
+		}
+	}
+}
+
+func (l *durableLog) writePending() {
+	l.lock.Lock()
+	records := l.pending
+	l.pending = nil
+	l.pendingBytes = 0
+	l.cond.Broadcast()
+	l.lock.Unlock()
+	if len(records) == 0 {
+		return
+	}
+
+	for i, rec := range records {
+		err := l.write(rec)
+		if err != nil {
+			elog.Errorf("could not write %d notifications to the durable log: %s", len(records)-i, err)
+			break
+		}
+	}
+	if l.cfg.SyncPolicy == SyncAlways {
+		l.sync()
+	}
+
+	l.lock.Lock()
+	// even if some of them couldn't be written, so that Read doesn't wait for
+	// them forever
+	l.writtenOffset = records[len(records)-1].offset
+	l.cond.Broadcast()
+	l.lock.Unlock()
+}
+
+func (l *durableLog) write(rec pendingLogRecord) error {
+	if l.segmentSize >= l.cfg.SegmentSize {
+		err := l.startSegment(rec.offset)
+		if err != nil {
+			return err
+		}
+		l.applyRetention()
+	}
+
+	_, err := l.w.Write(rec.data)
+	if err == nil {
+		err = l.w.Flush()
+	}
+	if err != nil {
+		// don't leave a partial record behind
+		_ = l.file.Truncate(l.segmentSize)
+		_, _ = l.file.Seek(l.segmentSize, io.SeekStart)
+		l.w.Reset(l.file)
+		return err
+	}
+	l.segmentSize += int64(len(rec.data))
+	l.dirty = true
+	return nil
+}
+
+func (l *durableLog) sync() {
+	if !l.dirty || l.cfg.SyncPolicy == SyncNever {
+		return
+	}
+	err := l.file.Sync()
+	if err != nil {
+		elog.Errorf("could not fsync the durable log: %s", err)
+	}
+	l.dirty = false
+}
+
+// Writes and syncs the pending records and stops the writer goroutine.
+// Append fails after Close has been called.
+func (l *durableLog) Close() {
+	l.lock.Lock()
+	if l.closed {
+		l.lock.Unlock()
+		return
+	}
+	l.closed = true
+	l.cond.Broadcast()
+	l.lock.Unlock()
+
+	close(l.stop)
+	<-l.stopped
+}
+
+// Removes the oldest segments according to the retention settings.  The
+// current segment is never removed.  The caller must be the writer goroutine.
+func (l *durableLog) applyRetention() {
+	l.lock.Lock()
+	segments := make([]logSegment, len(l.segments))
+	copy(segments, l.segments)
+	l.lock.Unlock()
+
+	var totalSize int64
+	sizes := make([]int64, len(segments))
+	modTimes := make([]time.Time, len(segments))
+	for i, seg := range segments {
+		fi, err := os.Stat(seg.path)
+		if err != nil {
+			continue
+		}
+		sizes[i] = fi.Size()
+		modTimes[i] = fi.ModTime()
+		totalSize += fi.Size()
+	}
+
+	remove := 0
+	for remove < len(segments)-1 {
+		tooBig := l.cfg.RetentionSize > 0 && totalSize > l.cfg.RetentionSize
+		tooOld := l.cfg.RetentionAge > 0 && time.Since(modTimes[remove]) > l.cfg.RetentionAge
+		if !tooBig && !tooOld {
+			break
+		}
+		err := os.Remove(segments[remove].path)
+		if err != nil && !os.IsNotExist(err) {
+			elog.Warningf("could not remove log segment %q: %s", segments[remove].path, err)
+			break
+		}
+		totalSize -= sizes[remove]
+		remove++
+	}
+	if remove > 0 {
+		// only the writer goroutine adds segments, so the ones we looked at
+		// are still at the front
+		l.lock.Lock()
+		l.segments = l.segments[remove:]
+		l.lock.Unlock()
+	}
+}
+
+// Reads the records in the segment at path starting at position start, which
+// must be the beginning of a record, calling fn for every record until fn
+// returns false.  endPos is the position just after the record.  Reading stops
+// without an error at the first incomplete or corrupt record.
+func readLogSegment(path string, start int64, fn func(r *logRecord, endPos int64) bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Seek(start, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	rd := bufio.NewReader(f)
+	pos := start
+	var header [logRecordHeaderSize]byte
+	for {
+		_, err = io.ReadFull(rd, header[:])
+		if err != nil {
+			return nil
+		}
+		length := binary.BigEndian.Uint32(header[0:])
+		if length < logRecordFixedBodySize {
+			return nil
+		}
+		body := make([]byte, length)
+		_, err = io.ReadFull(rd, body)
+		if err != nil {
+			return nil
+		}
+		if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[4:]) {
+			return nil
+		}
+		channelLen := binary.BigEndian.Uint32(body[24:])
+		if uint64(channelLen) > uint64(length-logRecordFixedBodySize) {
+			return nil
+		}
+		r := &logRecord{
+			offset:   binary.BigEndian.Uint64(body[0:]),
+			received: time.Unix(0, int64(binary.BigEndian.Uint64(body[8:]))),
+		}
+		r.n.BePid = int(int64(binary.BigEndian.Uint64(body[16:])))
+		r.n.Channel = string(body[logRecordFixedBodySize : logRecordFixedBodySize+channelLen])
+		r.n.Extra = string(body[logRecordFixedBodySize+channelLen:])
+
+		pos += int64(len(header)) + int64(length)
+		if !fn(r, pos) {
+			return nil
+		}
+	}
+}
+
+func (l *durableLog) LastOffset() uint64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.lastOffset
+}
+
+// durableLogCursor reads the records on a channel in batches, so that a
+// consumer far behind doesn't need the whole backlog in memory at once.
+type durableLogCursor struct {
+	l       *durableLog
+	channel string
+	upTo    uint64
+
+	// the offset of the last record looked at, and the segment and the
+	// position in it where the next one starts
+	after uint64
+	path  string
+	pos   int64
+}
+
+// Returns a cursor reading the records on channel with an offset greater than
+// after and not greater than upTo, oldest first.  gap is true if some of those
+// records have already been removed by retention.  Waits for the records up
+// to upTo to be written to disk.
+func (l *durableLog) Read(channel string, after, upTo uint64) (cursor *durableLogCursor, gap bool) {
+	l.lock.Lock()
+	for l.writtenOffset < min(upTo, l.lastOffset) && !l.closed {
+		l.cond.Wait()
+	}
+	gap = len(l.segments) > 0 && after+1 < l.segments[0].firstOffset
+	l.lock.Unlock()
+
+	cursor = &durableLogCursor{
+		l:       l,
+		channel: channel,
+		upTo:    upTo,
+		after:   after,
+	}
+	return cursor, gap
+}
+
+// Returns the next records, at most limit of them.  more is false once all of
+// the records have been read.  Records removed by retention in the meanwhile
+// are skipped.  Implements replaySource.
+func (c *durableLogCursor) Next(limit int) (notifications []*pq.Notification, more bool, err error) {
+	c.l.lock.Lock()
+	segments := make([]logSegment, len(c.l.segments))
+	copy(segments, c.l.segments)
+	c.l.lock.Unlock()
+
+	for c.after < c.upTo {
+		// the segment containing the record after c.after, or the oldest
+		// one if that has been removed already
+		i := sort.Search(len(segments), func(i int) bool {
+			return segments[i].firstOffset > c.after+1
+		}) - 1
+		if i < 0 {
+			i = 0
+		}
+		if i >= len(segments) {
+			break
+		}
+		if segments[i].path != c.path {
+			c.path = segments[i].path
+			c.pos = 0
+		}
+
+		stopped := false
+		err = readLogSegment(c.path, c.pos, func(r *logRecord, endPos int64) bool {
+			if r.offset > c.upTo {
+				c.after = c.upTo
+				stopped = true
+				return false
+			}
+			c.pos = endPos
+			if r.offset <= c.after {
+				return true
+			}
+			c.after = r.offset
+			if r.n.Channel == c.channel {
+				n := newNotification(&r.n)
+				n.offset = r.offset
+				n.received = r.received
+				notifications = append(notifications, n.PqNotification())
+				if len(notifications) >= limit {
+					stopped = true
+					return false
+				}
+			}
+			return true
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return nil, false, err
+		}
+		if stopped {
+			break
+		}
+		// the end of the segment, or it was removed by retention while we
+		// were reading it
+		if i+1 >= len(segments) {
+			c.after = c.upTo
+			break
+		}
+		c.after = max(c.after, segments[i+1].firstOffset-1)
+	}
+	return notifications, c.after < c.upTo, nil
+}
+
+// Offsets are delivered to clients in the 32-bit process ID field of
+// NotificationResponse, so only the low 31 bits survive.  Returns the most
+// recent offset in the log with the same low 31 bits as value.
+func (l *durableLog) ExpandOffset(value uint32) uint64 {
+	const mask = 1<<31 - 1
+	last := l.LastOffset()
+	offset := last&^mask | uint64(value&mask)
+	if offset > last && offset > mask {
+		offset -= mask + 1
+	}
+	return offset
+}
+
+func (l *durableLog) ConsumerOffset(consumer string) uint64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.consumers[consumer]
+}
+
+// Records offset as the last offset acknowledged by consumer, and persists the
+// consumer offsets on disk.  A consumer can't acknowledge an offset which
+// hasn't been assigned yet, or move back to an older one.
+func (l *durableLog) Acknowledge(consumer string, offset uint64) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if offset > l.lastOffset {
+		return errOffsetNotInLog
+	}
+	if offset < l.consumers[consumer] {
+		return errOffsetBackwards
+	}
+	l.consumers[consumer] = offset
+	return l.writeConsumers()
+}
+
+func (l *durableLog) consumersPath() string {
+	return filepath.Join(l.cfg.Directory, "consumers.json")
+}
+
+func (l *durableLog) readConsumers() error {
+	data, err := os.ReadFile(l.consumersPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &l.consumers)
+}
+
+// The caller must be holding lock.
+func (l *durableLog) writeConsumers() error {
+	data, err := json.Marshal(l.consumers)
+	if err != nil {
+		return err
+	}
+	tmpPath := l.consumersPath() + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, l.consumersPath())
+}
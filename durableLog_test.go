@@ -0,0 +1,180 @@
+package main
+
+import (
+	"github.com/lib/pq"
+
+	"testing"
+	"time"
+)
+
+func TestDurableLog(t *testing.T) {
+	cfg := DurableLogConfig{
+		Enabled:     true,
+		Directory:   t.TempDir(),
+		SegmentSize: 64,
+	}
+	l, err := openDurableLog(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, ch := range []string{"foo", "bar", "foo", "foo"} {
+		err = l.Append(newNotification(&pq.Notification{Channel: ch, Extra: "payload", BePid: i << 40}))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = l.Acknowledge("worker", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Acknowledge("worker", 999999); err != errOffsetNotInLog {
+		t.Errorf("acknowledging an offset past the end returned %v", err)
+	}
+	if err := l.Acknowledge("worker", 0); err != errOffsetBackwards {
+		t.Errorf("moving the consumer back returned %v", err)
+	}
+
+	// everything must survive reopening the log
+	l.Close()
+	l, err = openDurableLog(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if l.LastOffset() != 4 {
+		t.Fatalf("unexpected last offset %d", l.LastOffset())
+	}
+	if len(l.segments) < 2 {
+		t.Fatalf("expected the log to have rotated; got %d segments", len(l.segments))
+	}
+	cursor, gap := l.Read("foo", l.ConsumerOffset("worker"), l.LastOffset())
+	if gap {
+		t.Errorf("unexpected gap")
+	}
+	notifications := readCursor(t, cursor, 1)
+	var offsets []uint64
+	for _, n := range notifications {
+		offsets = append(offsets, notificationFromPq(n).offset)
+		if expected := int(notificationFromPq(n).offset-1) << 40; n.BePid != expected {
+			t.Errorf("unexpected process ID %d; expected %d", n.BePid, expected)
+		}
+	}
+	if len(offsets) != 2 || offsets[0] != 3 || offsets[1] != 4 {
+		t.Errorf("unexpected offsets %v", offsets)
+	}
+}
+
+// Reads everything from cursor, limit records at a time.
+func readCursor(t *testing.T, cursor *durableLogCursor, limit int) []*pq.Notification {
+	var notifications []*pq.Notification
+	for {
+		batch, more, err := cursor.Next(limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(batch) > limit {
+			t.Fatalf("cursor returned %d records; expected at most %d", len(batch), limit)
+		}
+		notifications = append(notifications, batch...)
+		if !more {
+			return notifications
+		}
+	}
+}
+
+func TestDurableLogCursor(t *testing.T) {
+	l, err := openDurableLog(DurableLogConfig{
+		Enabled:     true,
+		Directory:   t.TempDir(),
+		SegmentSize: 200,
+		SyncPolicy:  SyncNever,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for i := 0; i < 50; i++ {
+		channel := "foo"
+		if i%3 == 0 {
+			channel = "bar"
+		}
+		err = l.Append(newNotification(&pq.Notification{Channel: channel}))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// records past upTo are left alone
+	cursor, _ := l.Read("foo", 5, 45)
+	var offsets []uint64
+	for _, n := range readCursor(t, cursor, 4) {
+		offsets = append(offsets, notificationFromPq(n).offset)
+	}
+	var expected []uint64
+	for offset := uint64(6); offset <= 45; offset++ {
+		if (offset-1)%3 != 0 {
+			expected = append(expected, offset)
+		}
+	}
+	if len(offsets) != len(expected) {
+		t.Fatalf("got offsets %v; expected %v", offsets, expected)
+	}
+	for i := range offsets {
+		if offsets[i] != expected[i] {
+			t.Fatalf("got offsets %v; expected %v", offsets, expected)
+		}
+	}
+}
+
+func TestDurableLogRetentionAge(t *testing.T) {
+	l, err := openDurableLog(DurableLogConfig{
+		Enabled:      true,
+		Directory:    t.TempDir(),
+		SegmentSize:  1,
+		RetentionAge: 20 * time.Millisecond,
+		SyncPolicy:   SyncNever,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for i := 0; i < 3; i++ {
+		err = l.Append(newNotification(&pq.Notification{Channel: "foo"}))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// wait for the records to be written
+	l.Read("foo", 0, l.LastOffset())
+
+	// the old segments must expire without anything else being appended
+	for i := 0; i < 100; i++ {
+		l.lock.Lock()
+		segments := len(l.segments)
+		l.lock.Unlock()
+		if segments == 1 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("old segments were not removed")
+}
+
+func TestDurableLogExpandOffset(t *testing.T) {
+	const mask = 1<<31 - 1
+	var tests = []struct {
+		last     uint64
+		value    uint32
+		expected uint64
+	}{
+		{10, 5, 5},
+		{mask + 10, 5, mask + 6},
+		{mask + 10, mask - 1, mask - 1},
+	}
+	for _, ts := range tests {
+		l := &durableLog{lastOffset: ts.last}
+		if got := l.ExpandOffset(ts.value); got != ts.expected {
+			t.Errorf("ExpandOffset(%d) with last offset %d returned %d; expected %d", ts.value, ts.last, got, ts.expected)
+		}
+	}
+}
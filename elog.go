@@ -1,10 +1,12 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"os"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -40,12 +42,130 @@ func (s LogSeverity) String() string {
 	}
 }
 
+func ParseLogSeverity(s string) (LogSeverity, error) {
+	for severity := DEBUG; severity <= PANIC; severity++ {
+		if strings.EqualFold(s, severity.String()) {
+			return severity, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid log level %q", s)
+}
+
+type LogFormat int
+
+const (
+	LogFormatText LogFormat = iota
+	LogFormatJSON
+)
+
+func ParseLogFormat(s string) (LogFormat, error) {
+	switch s {
+	case "text":
+		return LogFormatText, nil
+	case "json":
+		return LogFormatJSON, nil
+	default:
+		return 0, fmt.Errorf("invalid log format %q", s)
+	}
+}
+
+// LogFields are attached to every message written through a Logger.  In the
+// JSON format each one is a separate key of the object; in the text format
+// they're not shown, since the messages already mention the relevant details.
+type LogFields map[string]string
+
+// logOutput is where the formatted log lines end up.
+type logOutput interface {
+	WriteLine(severity LogSeverity, line []byte) error
+	// Whether lines should carry a timestamp; syslog adds its own.
+	Timestamps() bool
+}
+
+// streamOutput writes lines to an io.Writer.
+type streamOutput struct {
+	w io.Writer
+}
+
+func (o streamOutput) WriteLine(severity LogSeverity, line []byte) error {
+	_, err := o.w.Write(append(line, '\n'))
+	return err
+}
+
+func (o streamOutput) Timestamps() bool {
+	return true
+}
+
+// logSink is shared by a Logger and all Loggers derived from it using
+// WithFields.
+type logSink struct {
+	lock     sync.Mutex
+	minLevel LogSeverity
+	format   LogFormat
+	output   logOutput
+}
+
 type Logger struct {
-	elog *log.Logger
+	sink   *logSink
+	fields LogFields
+}
+
+// Returns a Logger which writes to the same destination as l, adding fields to
+// every message.
+func (l *Logger) WithFields(fields LogFields) *Logger {
+	if l == nil {
+		return nil
+	}
+	merged := make(LogFields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &Logger{
+		sink:   l.sink,
+		fields: merged,
+	}
+}
+
+func (l *Logger) format(severity LogSeverity, output string, now time.Time) []byte {
+	s := l.sink
+	if s.format == LogFormatJSON {
+		object := make(map[string]string, len(l.fields)+3)
+		for k, v := range l.fields {
+			object[k] = v
+		}
+		if s.output.Timestamps() {
+			object["time"] = now.Format(time.RFC3339Nano)
+		}
+		object["level"] = severity.String()
+		object["message"] = strings.TrimSuffix(output, "\n")
+		line, err := json.Marshal(object)
+		if err != nil {
+			panic(err)
+		}
+		return line
+	}
+
+	line := severity.String() + ":  " + strings.TrimSuffix(output, "\n")
+	if s.output.Timestamps() {
+		line = now.Format("2006-01-02 15:04:05.000 -0700") + " " + line
+	}
+	return []byte(line)
 }
 
 func (l *Logger) Print(severity LogSeverity, output string) {
-	l.elog.Print(time.Now().Format("2006-01-02 15:04:05.000 -0700") + " " + severity.String() + ":  " + output)
+	s := l.sink
+	s.lock.Lock()
+	if severity >= s.minLevel {
+		line := l.format(severity, output, time.Now())
+		err := s.output.WriteLine(severity, line)
+		if err != nil {
+			// not much else we can do
+			fmt.Fprintf(os.Stderr, "could not write to the log: %s\n%s\n", err, line)
+		}
+	}
+	s.lock.Unlock()
 
 	switch severity {
 	case FATAL:
@@ -101,6 +221,143 @@ func InitErrorLog(w io.Writer) {
 		panic("double init")
 	}
 	elog = &Logger{
-		elog: log.New(w, "", 0),
+		sink: &logSink{
+			minLevel: DEBUG,
+			format:   LogFormatText,
+			output:   streamOutput{w},
+		},
+	}
+}
+
+// LogConfig specifies what is logged, in which format and where.
+type LogConfig struct {
+	MinLevel LogSeverity
+	Format   LogFormat
+	// "stderr", "file" or "syslog"
+	Destination string
+	File        string
+	// zero means no limit
+	RotationSize int64
+	RotationAge  time.Duration
+
+	LogConnections    bool
+	LogDisconnections bool
+	LogListens        bool
+}
+
+// Applies cfg to elog, which must have been initialized by InitErrorLog.
+func ConfigureErrorLog(cfg LogConfig) error {
+	var output logOutput
+	switch cfg.Destination {
+	case "stderr":
+		output = streamOutput{os.Stderr}
+	case "file":
+		f, err := openLogFile(cfg.File, cfg.RotationSize, cfg.RotationAge)
+		if err != nil {
+			return err
+		}
+		output = f
+		handleLogFileReopenSignal(f)
+	case "syslog":
+		var err error
+		output, err = newSyslogOutput()
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid log destination %q", cfg.Destination)
+	}
+
+	s := elog.sink
+	s.lock.Lock()
+	s.minLevel = cfg.MinLevel
+	s.format = cfg.Format
+	s.output = output
+	s.lock.Unlock()
+	return nil
+}
+
+// logFile is a log file which is rotated once it grows larger than maxSize
+// or older than maxAge.  The rotated files are renamed by adding the time of
+// the rotation to their name.
+type logFile struct {
+	lock    sync.Mutex
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+func openLogFile(path string, maxSize int64, maxAge time.Duration) (*logFile, error) {
+	f := &logFile{
+		path:    path,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+	}
+	err := f.open()
+	if err != nil {
+		return nil, err
 	}
+	return f, nil
+}
+
+// The caller must be holding lock, or have exclusive access to f.
+func (f *logFile) open() error {
+	fh, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	fi, err := fh.Stat()
+	if err != nil {
+		_ = fh.Close()
+		return err
+	}
+	if f.f != nil {
+		_ = f.f.Close()
+	}
+	f.f = fh
+	f.size = fi.Size()
+	f.opened = time.Now()
+	return nil
+}
+
+// Closes and reopens the file, for use with external log rotation tools.
+func (f *logFile) Reopen() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.open()
+}
+
+// The caller must be holding lock.
+func (f *logFile) rotate(now time.Time) error {
+	rotated := f.path + "." + now.Format("20060102-150405.000")
+	err := os.Rename(f.path, rotated)
+	if err != nil {
+		return err
+	}
+	return f.open()
+}
+
+func (f *logFile) WriteLine(severity LogSeverity, line []byte) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	now := time.Now()
+	if (f.maxSize > 0 && f.size > 0 && f.size+int64(len(line))+1 > f.maxSize) ||
+		(f.maxAge > 0 && now.Sub(f.opened) >= f.maxAge) {
+		err := f.rotate(now)
+		if err != nil {
+			return err
+		}
+	}
+	n, err := f.f.Write(append(line, '\n'))
+	f.size += int64(n)
+	return err
+}
+
+func (f *logFile) Timestamps() bool {
+	return true
 }
@@ -0,0 +1,14 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"fmt"
+)
+
+func newSyslogOutput() (logOutput, error) {
+	return nil, fmt.Errorf("syslog is not supported on this platform")
+}
+
+func handleLogFileReopenSignal(f *logFile) {
+}
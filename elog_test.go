@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoggerFormats(t *testing.T) {
+	var buf bytes.Buffer
+	l := &Logger{sink: &logSink{
+		minLevel: LOG,
+		format:   LogFormatJSON,
+		output:   streamOutput{&buf},
+	}}
+
+	l.Debugf("not shown")
+	l.WithFields(LogFields{"client": "1.2.3.4:5", "channel": "foo"}).Warningf("hello %s\n", "world")
+
+	var object map[string]string
+	err := json.Unmarshal(buf.Bytes(), &object)
+	if err != nil {
+		t.Fatalf("could not parse %q: %s", buf.String(), err)
+	}
+	if object["level"] != "WARNING" || object["message"] != "hello world" ||
+		object["client"] != "1.2.3.4:5" || object["channel"] != "foo" || object["time"] == "" {
+		t.Errorf("unexpected log line %q", buf.String())
+	}
+
+	buf.Reset()
+	l.sink.format = LogFormatText
+	l.WithFields(LogFields{"client": "1.2.3.4:5"}).Logf("hello")
+	if !strings.HasSuffix(buf.String(), " LOG:  hello\n") {
+		t.Errorf("unexpected log line %q", buf.String())
+	}
+
+	severity, err := ParseLogSeverity("warning")
+	if err != nil || severity != WARNING {
+		t.Errorf("ParseLogSeverity returned %v, %v", severity, err)
+	}
+}
+
+func TestLogFileRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "allas.log")
+	f, err := openLogFile(path, 20, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"first line", "second line", "third"} {
+		err = f.WriteLine(LOG, []byte(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 files, found %d", len(entries))
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "second line\nthird\n" {
+		t.Errorf("unexpected contents %q", data)
+	}
+}
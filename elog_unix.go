@@ -0,0 +1,56 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"log/syslog"
+	"os"
+	ossignal "os/signal"
+	"syscall"
+)
+
+// syslogOutput writes to the local syslog socket.
+type syslogOutput struct {
+	w *syslog.Writer
+}
+
+func newSyslogOutput() (logOutput, error) {
+	w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, "allas")
+	if err != nil {
+		return nil, err
+	}
+	return syslogOutput{w}, nil
+}
+
+func (o syslogOutput) WriteLine(severity LogSeverity, line []byte) error {
+	switch severity {
+	case DEBUG:
+		return o.w.Debug(string(line))
+	case LOG:
+		return o.w.Info(string(line))
+	case WARNING:
+		return o.w.Warning(string(line))
+	case ERROR:
+		return o.w.Err(string(line))
+	default:
+		return o.w.Crit(string(line))
+	}
+}
+
+func (o syslogOutput) Timestamps() bool {
+	return false
+}
+
+// Reopens f whenever we receive SIGUSR1.
+func handleLogFileReopenSignal(f *logFile) {
+	ch := make(chan os.Signal, 1)
+	ossignal.Notify(ch, syscall.SIGUSR1)
+	go func() {
+		for range ch {
+			err := f.Reopen()
+			if err != nil {
+				elog.Errorf("could not reopen log file: %s", err)
+			}
+		}
+	}()
+}
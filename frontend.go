@@ -6,7 +6,7 @@ import (
 	"bytes"
 	"crypto/md5"
 	"encoding/hex"
-	"fmt"
+	"time"
 )
 
 type Frontend interface {
@@ -22,7 +22,37 @@ type Frontend interface {
 
 	Unlisten(channel string) error
 
+	// Like Listen, but only delivers the notifications on channel whose
+	// payload matches filter.  Replaces any filter from an earlier LISTEN on
+	// the same channel; a plain Listen removes it.
+	ListenWhere(channel string, filter *payloadFilter) error
+
+	// Like Listen, but first delivers the notifications in the channel's
+	// replay buffer with a sequence number greater than seq.  gap is true if
+	// some of those notifications are no longer available.  Returns
+	// errNoReplayBuffer if the channel doesn't have a replay buffer.
+	ListenFrom(channel string, seq uint64) (gap bool, err error)
+
+	// Like ListenFrom, but replays the notifications from the durable log
+	// which have not been acknowledged by consumer yet.  The session stays
+	// attached to the consumer until it disconnects.
+	ListenConsumer(channel, consumer string) (gap bool, err error)
+
+	// Records offset as the last offset acknowledged by the session's
+	// consumer.
+	Acknowledge(offset uint32) error
+
+	// Starts delivering notifications on all channels matching the pattern.
+	ListenPattern(pattern *channelPattern) error
+
+	UnlistenPattern(pattern string) error
+
+	// Stops listening on all channels and patterns.
 	UnlistenAll() error
+
+	// Returns the admin console, or nil if the frontend is not connected to
+	// the admin console database.
+	AdminConsole() *adminSession
 }
 
 type AuthConfig struct {
@@ -34,6 +64,26 @@ type AuthConfig struct {
 type virtualDatabase struct {
 	name string
 	auth AuthConfig
+
+	slowClientPolicy  SlowClientPolicy
+	slowClientTimeout time.Duration
+	queueDepth        int
+	// zero means no limit
+	maxChannelsPerClient int
+	// nil if clients of this database are not rate limited
+	rateLimit *RateLimitConfig
+	// prepended to the names of all channels used by clients of this
+	// database
+	channelPrefix string
+	// the channel prefixes of the other databases; channels starting with
+	// one of them are off limits
+	foreignPrefixes []string
+	channelACL      channelACL
+
+	// true for the admin console database, which has a list of users instead
+	// of auth
+	admin      bool
+	adminUsers []AuthConfig
 }
 
 type VirtualDatabaseConfiguration []virtualDatabase
@@ -47,35 +97,36 @@ func (c VirtualDatabaseConfiguration) find(dbname string) *virtualDatabase {
 	return nil
 }
 
-// Finds a database and returns the authentication method
-func (c VirtualDatabaseConfiguration) FindDatabase(name string) (authMethod string, ok bool) {
-	db := c.find(name)
-	if db == nil {
-		return "", false
+// Returns the authentication configuration for username, or nil if the user
+// may not connect to the database at all.  Regular databases have a single
+// AuthConfig; whether the user matches is up to the authentication method.
+func (db *virtualDatabase) authConfig(username string) *AuthConfig {
+	if !db.admin {
+		return &db.auth
+	}
+	for i := range db.adminUsers {
+		if db.adminUsers[i].user == username {
+			return &db.adminUsers[i]
+		}
 	}
-	return db.auth.method, true
+	return nil
 }
 
-func (c VirtualDatabaseConfiguration) MD5Auth(dbname string, username string, salt []byte, password []byte) (success bool, err error) {
+func (a *AuthConfig) MD5Auth(username string, salt []byte, password []byte) bool {
 	if !bytes.HasPrefix(password, []byte{'m', 'd', '5'}) {
-		return false, nil
+		return false
 	}
 	password = password[3:]
 
-	db := c.find(dbname)
-	if db == nil {
-		return false, fmt.Errorf("internal error: database %q disappeared", dbname)
-	}
-
-	if db.auth.user != username {
-		return false, nil
+	if a.user != username {
+		return false
 	}
 
 	md5 := func(input []byte) []byte {
 		s := md5.Sum(input)
 		return []byte(hex.EncodeToString(s[:]))
 	}
-	expected := md5(append(md5([]byte(db.auth.password+username)), salt...))
+	expected := md5(append(md5([]byte(a.password+username)), salt...))
 	expected = append(expected, 0)
-	return bytes.Compare(expected, password) == 0, nil
+	return bytes.Compare(expected, password) == 0
 }
@@ -7,23 +7,45 @@ import (
 
 	"github.com/johto/notifyutils/notifydispatcher"
 	"github.com/lib/pq"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 
 	"bytes"
 	"bufio"
+	"context"
 	"crypto/rand"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
 var (
-	errGracefulTermination  = errors.New("graceful termination")
-	errClientCouldNotKeepUp = errors.New("client could not keep up")
-	errLostServerConnection = errors.New("lost server connection")
+	errChannelPermissionDenied = errors.New("permission denied for channel")
+	errTooManyChannels         = errors.New("too many channels listened on by this session")
+	errChannelNameTooLong      = errors.New("channel name too long")
+	errGracefulTermination     = errors.New("graceful termination")
+	errClientCouldNotKeepUp    = errors.New("client could not keep up")
+	errLostServerConnection    = errors.New("lost server connection")
+	errAdminShutdown           = errors.New("terminated by administrator")
 )
 
+type DeliveryConfig struct {
+	// maximum number of notifications written to a client before flushing
+	MaxBatchSize int
+	// how long to wait for more notifications before flushing a batch which
+	// isn't full yet; zero means only notifications which are already
+	// waiting are included in the batch
+	MaxBatchLatency time.Duration
+	// rate limits applied to the notifications sent to each client
+	RateLimits []ChannelRateLimitConfig
+}
+
 // QueryResult + Sync (yes/no)
 type queryResultSync struct {
 	Result QueryResult
@@ -56,16 +78,54 @@ func (fcio *frontendConnectionIO) Close() error {
 type FrontendConnection struct {
 	// immutable
 	remoteAddr string
+	// carries the client's address, and the database and user once the
+	// client has authenticated
+	log *Logger
 
 	stream     *fbcore.MessageStream
 	dispatcher *notifydispatcher.NotifyDispatcher
-
+	patterns   *patternSubscriptions
+	replay     *replayBuffers
+	durableLog *durableLog
+	delivery   DeliveryConfig
+	admin      *adminConsole
+
+	// the context of the session's span; set by mainLoop
+	traceCtx context.Context
+
+	// set during startup
+	database    *virtualDatabase
+	username    string
+	id          int64
+	connectedAt time.Time
+
+	// closed when the connection to the server is lost; nil if there was no
+	// connection when the client connected, and for the admin console
 	connStatusNotifier chan struct{}
 	notify             chan *pq.Notification
+	queue              *notificationQueue
 	queryResultCh      chan queryResultSync
 
-	// owned by queryProcessingMainLoop until queryResultCh has been closed
+	// the notifications written to the stream but not flushed yet, and the
+	// timer which flushes them after delivery.MaxBatchLatency; owned by
+	// mainLoop
+	batchSize    int
+	batchTimer   *time.Timer
+	batchTimeout <-chan time.Time
+	// the metadata of the notifications in the batch which are included in
+	// the latency metrics; they're observed once the batch has been flushed
+	batchLatencies []notificationMetadata
+
+	// owned by queryProcessingMainLoop until queryResultCh has been closed;
+	// modifications are protected by listenLock so that the admin console
+	// can look at them
+	listenLock     sync.Mutex
 	listenChannels map[string]struct{}
+	listenPatterns map[string]struct{}
+	consumer       string
+
+	killed   chan struct{}
+	killOnce sync.Once
 
 	lock sync.Mutex
 	err  error
@@ -84,39 +144,101 @@ func initFatalMessage(message *fbcore.Message, sqlstate, errorMessage string) {
 	message.InitFromBytes(fbproto.MsgErrorResponseE, buf.Bytes())
 }
 
-func RejectFrontendConnection(c net.Conn) {
-	var message fbcore.Message
-	initFatalMessage(&message, "57A01", "no server connection available")
-
-	_, _ = message.WriteTo(c)
-	_ = c.Close()
-}
 
-func (c FrontendConnection) String() string {
+func (c *FrontendConnection) String() string {
 	return c.remoteAddr
 }
 
-func NewFrontendConnection(c net.Conn, dispatcher *notifydispatcher.NotifyDispatcher, connStatusNotifier chan struct{}) *FrontendConnection {
+func NewFrontendConnection(c net.Conn, dispatcher *notifydispatcher.NotifyDispatcher, patterns *patternSubscriptions, replay *replayBuffers, durableLog *durableLog, connStatusNotifier chan struct{}, delivery DeliveryConfig, admin *adminConsole) *FrontendConnection {
+	// The buffer should be large enough to hold a batch of notifications of
+	// typical size; see sendNotificationBatch.
 	io := &frontendConnectionIO{
 		c: c,
-		bufw: bufio.NewWriterSize(c, 128),
+		bufw: bufio.NewWriterSize(c, 8192),
 	}
 
 	fc := &FrontendConnection{
 		remoteAddr: c.RemoteAddr().String(),
+		log:        elog.WithFields(LogFields{"client": c.RemoteAddr().String()}),
+		traceCtx:   context.Background(),
 
 		stream:     fbcore.NewFrontendStream(io),
 		dispatcher: dispatcher,
+		patterns:   patterns,
+		replay:     replay,
+		durableLog: durableLog,
+		delivery:   delivery,
+		admin:      admin,
 
 		connStatusNotifier: connStatusNotifier,
-		notify:             make(chan *pq.Notification, 256),
 		queryResultCh:      make(chan queryResultSync, 8),
 
 		listenChannels: make(map[string]struct{}),
+		listenPatterns: make(map[string]struct{}),
+
+		killed: make(chan struct{}),
 	}
 	return fc
 }
 
+// clientInfo is a snapshot of the state of a client, as shown by the admin
+// console.
+type clientInfo struct {
+	id          int64
+	addr        string
+	database    string
+	user        string
+	connectedAt time.Time
+	channels    []string
+	// the same as channels, but with the database's channel prefix
+	upstreamChannels []string
+	patterns         []string
+	queued           int
+	consumer         string
+}
+
+// Returns the current state of the client.  Safe to call from any goroutine
+// once the client has been registered with the admin console.
+func (c *FrontendConnection) info() clientInfo {
+	info := clientInfo{
+		id:          c.id,
+		addr:        c.remoteAddr,
+		database:    c.database.name,
+		user:        c.username,
+		connectedAt: c.connectedAt,
+		queued:      c.queue.Len(),
+	}
+	c.listenLock.Lock()
+	for channel := range c.listenChannels {
+		info.channels = append(info.channels, strings.TrimPrefix(channel, c.database.channelPrefix))
+		info.upstreamChannels = append(info.upstreamChannels, channel)
+	}
+	for pattern := range c.listenPatterns {
+		info.patterns = append(info.patterns, pattern)
+	}
+	info.consumer = strings.TrimPrefix(c.consumer, c.database.channelPrefix)
+	c.listenLock.Unlock()
+	sort.Strings(info.channels)
+	sort.Strings(info.upstreamChannels)
+	sort.Strings(info.patterns)
+	return info
+}
+
+// Asks mainLoop to terminate the connection.
+func (c *FrontendConnection) kill() {
+	c.killOnce.Do(func() {
+		close(c.killed)
+	})
+}
+
+// Implements Frontend.AdminConsole.
+func (c *FrontendConnection) AdminConsole() *adminSession {
+	if !c.database.admin || c.admin == nil {
+		return nil
+	}
+	return &adminSession{c.admin, auditActor{c.remoteAddr, c.database.name, c.username}}
+}
+
 func (c *FrontendConnection) WriteAndFlush(msg *fbcore.Message) error {
 	err := c.WriteMessage(msg)
 	if err != nil {
@@ -125,19 +247,27 @@ func (c *FrontendConnection) WriteAndFlush(msg *fbcore.Message) error {
 	return c.FlushStream()
 }
 
-func (c *FrontendConnection) fatal(err error) {
-	c.setSessionError(err)
-
-	var sqlstate, errorMessage string
-
+// Returns the SQLSTATE and the message of the FATAL error sent to the client
+// when terminating the connection because of err.  ok is false if err doesn't
+// terminate the connection that way.
+func fatalError(err error) (sqlstate, errorMessage string, ok bool) {
 	switch err {
 	case errLostServerConnection:
-		sqlstate = "57A02"
-		errorMessage = "terminating connection because the server connection was lost"
+		return "57A02", "terminating connection because the server connection was lost", true
 	case errClientCouldNotKeepUp:
-		sqlstate = "57A03"
-		errorMessage = "terminating connection because the client could not keep up"
+		return "57A03", "terminating connection because the client could not keep up", true
+	case errAdminShutdown:
+		return "57P01", "terminating connection due to administrator command", true
 	default:
+		return "", "", false
+	}
+}
+
+func (c *FrontendConnection) fatal(err error) {
+	c.setSessionError(err)
+
+	sqlstate, errorMessage, ok := fatalError(err)
+	if !ok {
 		panic(err)
 	}
 
@@ -153,6 +283,14 @@ func (c *FrontendConnection) auth(dbcfg VirtualDatabaseConfiguration, sm *fbprot
 	authFailed := func(sqlstate, format string, v ...interface{}) bool {
 		var msg fbcore.Message
 		message := fmt.Sprintf(format, v...)
+		r := c.auditRecord("auth")
+		r.Result = "failure"
+		r.Reason = message
+		r.SQLState = sqlstate
+		audit.Record(r)
+		if Config.Log.LogConnections {
+			c.log.WithFields(LogFields{"sqlstate": sqlstate}).Logf("client %s failed to connect: %s", c, message)
+		}
 		initFatalMessage(&msg, sqlstate, message)
 		_ = c.WriteMessage(&msg)
 		_ = c.FlushStream()
@@ -163,29 +301,36 @@ func (c *FrontendConnection) auth(dbcfg VirtualDatabaseConfiguration, sm *fbprot
 	if !ok {
 		return authFailed("08P01", `required startup parameter "user" nor present in startup packet`)
 	}
+	c.username = username
 	dbname, ok := sm.Params["database"]
 	if !ok {
 		dbname = username
 	}
-	authMethod, ok := dbcfg.FindDatabase(dbname)
-	if !ok {
+	c.database = dbcfg.find(dbname)
+	if c.database == nil {
+		MetricDatabaseAuthFailures.WithLabelValues("unknown").Inc()
 		return authFailed("3D000", "database %q does not exist", dbname)
 	}
+	authCfg := c.database.authConfig(username)
+	if authCfg == nil {
+		MetricDatabaseAuthFailures.WithLabelValues(dbname).Inc()
+		return authFailed("28000", "user %q is not allowed to connect to database %q", username, dbname)
+	}
 
-	switch authMethod {
+	switch authCfg.method {
 	case "trust":
 		return true
 	case "md5":
 		// handled below
 	default:
-		elog.Errorf("unrecognized authentication method %q", authMethod)
+		c.log.Errorf("unrecognized authentication method %q", authCfg.method)
 		return authFailed("XX000", "internal error")
 	}
 
 	salt := make([]byte, 4)
 	_, err := rand.Read(salt)
 	if err != nil {
-		elog.Errorf("could not generate random salt: %s", err)
+		c.log.Errorf("could not generate random salt: %s", err)
 		return authFailed("XX000", "internal error")
 	}
 
@@ -196,15 +341,15 @@ func (c *FrontendConnection) auth(dbcfg VirtualDatabaseConfiguration, sm *fbprot
 	msg.InitFromBytes(fbproto.MsgAuthenticationMD5PasswordR, buf.Bytes())
 	err = c.WriteAndFlush(&msg)
 	if err != nil {
-		elog.Logf("error during startup sequence: %s", err)
+		c.log.Logf("error during startup sequence: %s", err)
 		return false
 	}
 	err = c.stream.Next(&msg)
 	if err == io.EOF {
-		elog.Debugf("EOF during startup sequence")
+		c.log.Debugf("EOF during startup sequence")
 		return false
 	} else if err != nil {
-		elog.Logf("error during startup sequence: %s", err)
+		c.log.Logf("error during startup sequence: %s", err)
 		return false
 	}
 	if msg.MsgType() != fbproto.MsgPasswordMessageP {
@@ -212,19 +357,16 @@ func (c *FrontendConnection) auth(dbcfg VirtualDatabaseConfiguration, sm *fbprot
 	}
 	// don't bother with messages which are clearly too big
 	if msg.Size() > 100 {
+		MetricDatabaseAuthFailures.WithLabelValues(dbname).Inc()
 		return authFailed("28001", "password authentication failed for user %q", username)
 	}
 	password, err := msg.Force()
 	if err != nil {
-		elog.Logf("error during startup sequence: %s", err)
-		return false
-	}
-	success, err := dbcfg.MD5Auth(dbname, username, salt, password)
-	if err != nil {
-		elog.Logf("error during startup sequence: %s", err)
+		c.log.Logf("error during startup sequence: %s", err)
 		return false
 	}
-	if !success {
+	if !authCfg.MD5Auth(username, salt, password) {
+		MetricDatabaseAuthFailures.WithLabelValues(dbname).Inc()
 		return authFailed("28001", "password authentication failed for user %q", username)
 	}
 	return true
@@ -234,10 +376,13 @@ func (c *FrontendConnection) startup(startupParameters map[string]string, dbcfg
 	var message fbcore.Message
 	var err error
 
+	ctx, span := tracer.Start(c.traceCtx, "startup")
+	defer span.End()
+
 	for {
 		err = c.stream.Next(&message)
 		if err != nil {
-			elog.Logf("error while reading startup packet: %s", err)
+			c.log.Logf("error while reading startup packet: %s", err)
 			return false
 		}
 		if fbproto.IsStartupMessage(&message) {
@@ -245,42 +390,66 @@ func (c *FrontendConnection) startup(startupParameters map[string]string, dbcfg
 		} else if fbproto.IsSSLRequest(&message) {
 			_, err = message.Force()
 			if err != nil {
-				elog.Logf("error while reading SSLRequest: %s", err)
+				c.log.Logf("error while reading SSLRequest: %s", err)
 				return false
 			}
 			err = c.stream.SendSSLRequestResponse(fbcore.RejectSSLRequest)
 			if err != nil {
-				elog.Logf("error during startup sequence: %s", err)
+				c.log.Logf("error during startup sequence: %s", err)
 				return false
 			}
 			err = c.FlushStream()
 			if err != nil {
-				elog.Logf("error during startup sequence: %s", err)
+				c.log.Logf("error during startup sequence: %s", err)
 			}
 		} else if fbproto.IsCancelRequest(&message) {
 			_ = c.stream.Close()
 			return false
 		} else {
-			elog.Warningf("unrecognized frontend message type 0x%x during startup", message.MsgType())
+			c.log.Warningf("unrecognized frontend message type 0x%x during startup", message.MsgType())
 			return false
 		}
 	}
 	sm, err := fbproto.ReadStartupMessage(&message)
 	if err != nil {
-		elog.Logf("error while reading startup packet: %s", err)
+		c.log.Logf("error while reading startup packet: %s", err)
 		return false
 	}
 
-	if !c.auth(dbcfg, sm) {
+	_, authSpan := tracer.Start(ctx, "auth")
+	ok := c.auth(dbcfg, sm)
+	if !ok {
+		authSpan.SetStatus(codes.Error, "authentication failed")
+		authSpan.End()
 		// error already logged
 		_ = c.stream.Close()
 		return false
 	}
+	authSpan.SetAttributes(attrDatabase.String(c.database.name), attrUser.String(c.username))
+	authSpan.End()
+	if c.database.admin {
+		// The admin console doesn't need the server, and is most useful
+		// while the connection to it is down.
+		c.connStatusNotifier = nil
+	} else if c.connStatusNotifier == nil {
+		initFatalMessage(&message, "57A01", "no server connection available")
+		_ = c.WriteMessage(&message)
+		_ = c.FlushStream()
+		_ = c.stream.Close()
+		return false
+	}
+	c.log = c.log.WithFields(LogFields{"database": c.database.name, "user": c.username})
+	r := c.auditRecord("auth")
+	r.Result = "success"
+	audit.Record(r)
+	if Config.Log.LogConnections {
+		c.log.Logf("client %s connected to database %q as user %q", c, c.database.name, c.username)
+	}
 
 	fbproto.InitAuthenticationOk(&message)
 	err = c.WriteMessage(&message)
 	if err != nil {
-		elog.Logf("error during startup sequence: %s", err)
+		c.log.Logf("error during startup sequence: %s", err)
 		return false
 	}
 
@@ -291,7 +460,7 @@ func (c *FrontendConnection) startup(startupParameters map[string]string, dbcfg
 		message.InitFromBytes(fbproto.MsgParameterStatusS, buf.Bytes())
 		err = c.WriteMessage(&message)
 		if err != nil {
-			elog.Logf("error during startup sequence: %s", err)
+			c.log.Logf("error during startup sequence: %s", err)
 			return false
 		}
 	}
@@ -299,13 +468,13 @@ func (c *FrontendConnection) startup(startupParameters map[string]string, dbcfg
 	fbproto.InitReadyForQuery(&message, fbproto.RfqIdle)
 	err = c.WriteMessage(&message)
 	if err != nil {
-		elog.Logf("error during startup sequence: %s", err)
+		c.log.Logf("error during startup sequence: %s", err)
 		return false
 	}
 
 	err = c.FlushStream()
 	if err != nil {
-		elog.Logf("error during startup sequence: %s", err)
+		c.log.Logf("error during startup sequence: %s", err)
 		return false
 	}
 	return true
@@ -330,20 +499,149 @@ func (c *FrontendConnection) FlushStream() error {
 	return c.stream.Flush()
 }
 
+// Returns the name of channel (or durable log consumer) as seen by the
+// server and the rest of allas.  Channels of virtual databases with a
+// channel_prefix are isolated from each other by prepending the prefix to
+// every channel name used by the client, and stripping it from the
+// notifications sent to the client.  The channel names we keep track of in
+// FrontendConnection and the notification queue are the prefixed ones.
+func (c *FrontendConnection) upstreamName(name string) string {
+	return c.database.channelPrefix + name
+}
+
+// The server truncates channel names longer than NAMEDATALEN-1 bytes, and the
+// notifications on the truncated channel would never reach us.
+const maxChannelNameLength = 63
+
+// Returns errChannelPermissionDenied if the client is not allowed to listen on
+// channel, and errChannelNameTooLong if the server would truncate its name.
+func (c *FrontendConnection) checkChannel(channel string) error {
+	if len(c.upstreamName(channel)) > maxChannelNameLength {
+		return errChannelNameTooLong
+	}
+	allowed := c.database.channelACL.Allowed(channel)
+	for _, prefix := range c.database.foreignPrefixes {
+		if strings.HasPrefix(channel, prefix) {
+			allowed = false
+		}
+	}
+	if allowed {
+		return nil
+	}
+	r := c.auditRecord("listen")
+	r.Channel = channel
+	r.Result = "denied"
+	r.SQLState = "42501"
+	audit.Record(r)
+	c.log.WithFields(LogFields{"channel": channel, "sqlstate": "42501"}).Warningf("client %s denied permission to listen on channel %q in database %q", c, channel, c.database.name)
+	MetricChannelPermissionDenied.WithLabelValues(c.database.name).Inc()
+	return errChannelPermissionDenied
+}
+
+// Records a LISTEN or UNLISTEN in the audit log, and logs it if log_listens
+// is enabled.  channel is the channel (or pattern) as seen by the client.
+func (c *FrontendConnection) logListen(command, channel string) {
+	r := c.auditRecord(strings.ToLower(strings.Replace(command, " ", "_", -1)))
+	if strings.HasSuffix(command, "PATTERN") {
+		r.Pattern = channel
+	} else {
+		r.Channel = channel
+	}
+	audit.Record(r)
+
+	if !Config.Log.LogListens {
+		return
+	}
+	c.log.WithFields(LogFields{"channel": channel}).Logf("client %s executed %s %q", c, command, channel)
+}
+
+// Returns an audit log record of event with the details of the client filled
+// in.
+func (c *FrontendConnection) auditRecord(event string) auditRecord {
+	r := auditRecord{
+		Event:  event,
+		Client: c.remoteAddr,
+		User:   c.username,
+	}
+	if c.database != nil {
+		r.Database = c.database.name
+	}
+	return r
+}
+
 // Implements Frontend.Listen.
 func (c *FrontendConnection) Listen(channel string) error {
-	c.listenChannels[channel] = struct{}{}
+	err := c.checkChannel(channel)
+	if err != nil {
+		return err
+	}
+	channel = c.upstreamName(channel)
+	return c.listenFiltered(channel, nil)
+}
+
+// Implements Frontend.ListenWhere.
+func (c *FrontendConnection) ListenWhere(channel string, filter *payloadFilter) error {
+	err := c.checkChannel(channel)
+	if err != nil {
+		return err
+	}
+	channel = c.upstreamName(channel)
+	return c.listenFiltered(channel, filter)
+}
+
+// Listens on channel, replacing its payload filter with filter.  The filter is
+// installed before we start listening so that no unfiltered notifications can
+// slip through, and the previous one is put back if listening fails.
+func (c *FrontendConnection) listenFiltered(channel string, filter *payloadFilter) error {
+	previous := c.queue.SetFilter(channel, filter)
+	err := c.listen(channel)
+	if err != nil {
+		c.queue.SetFilter(channel, previous)
+	}
+	return err
+}
+
+func (c *FrontendConnection) listen(channel string) error {
+	_, ok := c.listenChannels[channel]
+	if !ok {
+		max := c.database.maxChannelsPerClient
+		if max > 0 && len(c.listenChannels) >= max {
+			return errTooManyChannels
+		}
+	}
 	err := c.dispatcher.Listen(channel, c.notify)
 	if err != nil && err != notifydispatcher.ErrChannelAlreadyActive {
 		return err
 	}
+	if !ok {
+		MetricChannelListeners.WithLabelValues(channelLabels.Label(channel)).Inc()
+		c.logListen("LISTEN", strings.TrimPrefix(channel, c.database.channelPrefix))
+	}
+	c.listenLock.Lock()
+	c.listenChannels[channel] = struct{}{}
+	c.listenLock.Unlock()
+	c.patterns.AddChannel(channel, c.notify)
 	MetricListensExecuted.Inc()
 	return nil
 }
 
 // Implements Frontend.Unlisten.
 func (c *FrontendConnection) Unlisten(channel string) error {
+	return c.unlisten(c.upstreamName(channel))
+}
+
+func (c *FrontendConnection) unlisten(channel string) error {
+	_, ok := c.listenChannels[channel]
+	if ok {
+		MetricChannelListeners.WithLabelValues(channelLabels.Label(channel)).Dec()
+		c.logListen("UNLISTEN", strings.TrimPrefix(channel, c.database.channelPrefix))
+	}
+	c.listenLock.Lock()
 	delete(c.listenChannels, channel)
+	c.listenLock.Unlock()
+	c.patterns.RemoveChannel(channel, c.notify)
+	c.queue.StopReplay(channel)
+	c.queue.SetFilter(channel, nil)
 	err := c.dispatcher.Unlisten(channel, c.notify)
 	if err != nil && err != notifydispatcher.ErrChannelNotActive {
 		return err
@@ -352,16 +650,122 @@ func (c *FrontendConnection) Unlisten(channel string) error {
 	return nil
 }
 
+// Implements Frontend.ListenFrom.  We start listening before looking at the
+// replay buffer so that no notifications can fall between the two; the queue
+// takes care of skipping the ones we've replayed.
+func (c *FrontendConnection) ListenFrom(channel string, seq uint64) (gap bool, err error) {
+	err = c.checkChannel(channel)
+	if err != nil {
+		return false, err
+	}
+	channel = c.upstreamName(channel)
+	if !c.replay.HasBuffer(channel) {
+		return false, errNoReplayBuffer
+	}
+	err = c.listenFiltered(channel, nil)
+	if err != nil {
+		return false, err
+	}
+	notifications, lastSeq, gap, err := c.replay.Since(channel, seq)
+	if err != nil {
+		return false, err
+	}
+	c.queue.Replay(channel, sliceReplaySource(notifications), replayPosition{lastSeq, false})
+	return gap, nil
+}
+
+// Implements Frontend.ListenConsumer.  See ListenFrom.  Consumer names are
+// namespaced the same way as channel names.
+func (c *FrontendConnection) ListenConsumer(channel, consumer string) (gap bool, err error) {
+	if c.durableLog == nil {
+		return false, errNoDurableLog
+	}
+	err = c.checkChannel(channel)
+	if err != nil {
+		return false, err
+	}
+	channel = c.upstreamName(channel)
+	consumer = c.upstreamName(consumer)
+	if c.consumer != "" && c.consumer != consumer {
+		return false, errConsumerMismatch
+	}
+	c.listenLock.Lock()
+	c.consumer = consumer
+	c.listenLock.Unlock()
+
+	err = c.listenFiltered(channel, nil)
+	if err != nil {
+		return false, err
+	}
+	upTo := c.durableLog.LastOffset()
+	cursor, gap := c.durableLog.Read(channel, c.durableLog.ConsumerOffset(consumer), upTo)
+	c.queue.Replay(channel, cursor.Next, replayPosition{upTo, true})
+	return gap, nil
+}
+
+// Implements Frontend.Acknowledge.
+func (c *FrontendConnection) Acknowledge(offset uint32) error {
+	if c.durableLog == nil {
+		return errNoDurableLog
+	}
+	if c.consumer == "" {
+		return errNoConsumer
+	}
+	return c.durableLog.Acknowledge(c.consumer, c.durableLog.ExpandOffset(offset))
+}
+
+// Implements Frontend.ListenPattern.
+func (c *FrontendConnection) ListenPattern(pattern *channelPattern) error {
+	if c.database.channelPrefix != "" {
+		var err error
+		pattern, err = newLikePattern(c.upstreamLikePattern(pattern.String()))
+		if err != nil {
+			return err
+		}
+	}
+	c.listenLock.Lock()
+	c.listenPatterns[pattern.String()] = struct{}{}
+	c.listenLock.Unlock()
+	c.logListen("LISTEN PATTERN", strings.TrimPrefix(pattern.String(), escapeLikePattern(c.database.channelPrefix)))
+	c.patterns.Listen(pattern, c.notify)
+	MetricListensExecuted.Inc()
+	return nil
+}
+
+func (c *FrontendConnection) upstreamLikePattern(pattern string) string {
+	return escapeLikePattern(c.database.channelPrefix) + pattern
+}
+
+// Implements Frontend.UnlistenPattern.
+func (c *FrontendConnection) UnlistenPattern(pattern string) error {
+	return c.unlistenPattern(c.upstreamLikePattern(pattern))
+}
+
+func (c *FrontendConnection) unlistenPattern(pattern string) error {
+	c.listenLock.Lock()
+	delete(c.listenPatterns, pattern)
+	c.listenLock.Unlock()
+	c.logListen("UNLISTEN PATTERN", strings.TrimPrefix(pattern, escapeLikePattern(c.database.channelPrefix)))
+	c.patterns.Unlisten(pattern, c.notify)
+	MetricUnlistensExecuted.Inc()
+	return nil
+}
+
 // Implements Frontend.UnlistenAll.
 func (c *FrontendConnection) UnlistenAll() error {
 	var firstErr error
 	for channel := range c.listenChannels {
-		err := c.Unlisten(channel)
+		err := c.unlisten(channel)
 		if err != nil && firstErr == nil {
 			firstErr = err
 		}
 	}
+	c.listenLock.Lock()
 	c.listenChannels = make(map[string]struct{})
+	c.listenLock.Unlock()
+	for pattern := range c.listenPatterns {
+		_ = c.unlistenPattern(pattern)
+	}
 	return firstErr
 }
 
@@ -476,6 +880,28 @@ func (c *FrontendConnection) discardUntilSync() error {
 	}
 }
 
+// Returns the name of the span of a message of type typ from the frontend.
+func messageSpanName(typ byte) string {
+	switch typ {
+	case fbproto.MsgParseP:
+		return "Parse"
+	case fbproto.MsgBindB:
+		return "Bind"
+	case fbproto.MsgDescribeD:
+		return "Describe"
+	case fbproto.MsgExecuteE:
+		return "Execute"
+	case fbproto.MsgSyncS:
+		return "Sync"
+	case fbproto.MsgQueryQ:
+		return "Query"
+	case fbproto.MsgTerminateX:
+		return "Terminate"
+	default:
+		return "unknown message"
+	}
+}
+
 // This is the main loop for processing messages from the frontend.  Note that
 // we must *never* send anything directly to the connection; all communication
 // must go through queryResultCh.  We're also not responsible for doing any
@@ -486,6 +912,9 @@ func (c *FrontendConnection) queryProcessingMainLoop() {
 	var queryResult QueryResult
 	var sendReadyForQuery bool
 
+	// the span of the message being processed
+	var span trace.Span
+
 sessionLoop:
 	for {
 		var message fbcore.Message
@@ -495,6 +924,7 @@ sessionLoop:
 			c.setSessionError(err)
 			break sessionLoop
 		}
+		_, span = tracer.Start(c.traceCtx, messageSpanName(message.MsgType()))
 
 		queryResult = nil
 		sendReadyForQuery = false
@@ -506,7 +936,11 @@ sessionLoop:
 				c.setSessionError(err)
 				break sessionLoop
 			}
+			span.SetAttributes(attrQuery.String(queryString))
 			unnamedStatement, err = ParseQuery(queryString)
+			if err == nil {
+				unnamedStatement = RestrictQuery(unnamedStatement, c.database.admin)
+			}
 			if err != nil {
 				queryResult = NewErrorResponse("42601", err.Error())
 				c.queryResultCh <- queryResultSync{queryResult, false}
@@ -574,10 +1008,12 @@ sessionLoop:
 				c.setSessionError(err)
 				break sessionLoop
 			}
+			span.SetAttributes(attrQuery.String(query.Query))
 			q, err := ParseQuery(query.Query)
 			if err != nil {
 				queryResult = NewErrorResponse("42601", err.Error())
 			} else {
+				q = RestrictQuery(q, c.database.admin)
 				resultDescription := q.Describe()
 				// Special case in SimpleQuery processing: we only send the
 				// Describe() response over if it's a RowDescription.  This is
@@ -607,24 +1043,149 @@ sessionLoop:
 		}
 
 		if queryResult != nil {
+			if errorResponse, ok := queryResult.(errorResponse); ok {
+				span.SetAttributes(attrSQLState.String(errorResponse.sqlstate))
+				span.SetStatus(codes.Error, errorResponse.errorMessage)
+			}
 			c.queryResultCh <- queryResultSync{queryResult, sendReadyForQuery}
 		}
+		span.End()
+		span = nil
+	}
+	if span != nil {
+		span.End()
 	}
 
 	// wake mainLoop to clean up
 	close(c.queryResultCh)
 }
 
+// Sets up the queue between the dispatcher and the client according to the
+// slow client settings of the database.  Notifications are moved into the
+// queue in a separate goroutine until done is closed.
+func (c *FrontendConnection) startNotificationQueue(done <-chan struct{}) {
+	db := c.database
+	c.notify = make(chan *pq.Notification, notifyChannelSize(db.queueDepth))
+	c.queue = newNotificationQueue(
+		db.slowClientPolicy,
+		db.slowClientTimeout,
+		db.queueDepth,
+		MetricNotificationsDropped.WithLabelValues(db.name),
+	)
+	c.queue.SetRateLimits(c.delivery.RateLimits, db.rateLimit)
+	if len(db.channelACL.allowed) > 0 || len(db.channelACL.denied) > 0 {
+		// Exact channels are checked by LISTEN, but patterns can match any
+		// channel.
+		c.queue.channelAllowed = func(channel string) bool {
+			return db.channelACL.Allowed(strings.TrimPrefix(channel, db.channelPrefix))
+		}
+	}
+	go c.queue.pump(c.notify, done)
+}
+
+func (c *FrontendConnection) sendNotificationsDroppedNotice(dropped int) error {
+	message := fmt.Sprintf("%d notifications dropped because the client could not keep up", dropped)
+	return NewNoticeResponse("01000", message, nil).Respond(c)
+}
+
+// Writes a NotificationResponse into the stream without flushing it.
 func (c *FrontendConnection) sendNotification(n *pq.Notification) error {
 	var message fbcore.Message
 
 	buf := &bytes.Buffer{}
 	fbbuf.WriteInt32(buf, int32(n.BePid))
-	fbbuf.WriteCString(buf, n.Channel)
+	fbbuf.WriteCString(buf, strings.TrimPrefix(n.Channel, c.database.channelPrefix))
 	fbbuf.WriteCString(buf, n.Extra)
 	message.InitFromBytes(fbproto.MsgNotificationResponseA, buf.Bytes())
 
-	return c.WriteAndFlush(&message)
+	err := c.WriteMessage(&message)
+	if err != nil {
+		return err
+	}
+	nn := notificationFromPq(n)
+	if nn.span.IsSampled() && !nn.replayed {
+		// The span covers the time from us receiving the notification to
+		// writing it to this client.
+		_, span := tracer.Start(trace.ContextWithSpanContext(context.Background(), nn.span), "deliver",
+			trace.WithTimestamp(nn.received),
+			trace.WithAttributes(
+				attrChannel.String(n.Channel),
+				attrDatabase.String(c.database.name),
+				attrClient.String(c.remoteAddr),
+			))
+		span.End()
+	}
+	MetricNotificationsDispatched.Inc()
+	MetricChannelNotificationsDispatched.WithLabelValues(c.database.name, channelLabels.Label(n.Channel)).Inc()
+	if !nn.replayed {
+		c.batchLatencies = append(c.batchLatencies, nn.notificationMetadata)
+	}
+	return nil
+}
+
+// Sends the notifications waiting in the queue to the client.  Once
+// delivery.MaxBatchSize notifications have been sent, or if
+// delivery.MaxBatchLatency is not set, the stream is flushed right away.
+// Otherwise a timer is started, and mainLoop calls flushNotificationBatch once
+// it fires, unless the batch fills up before that.  Returns
+// errClientCouldNotKeepUp if the slow client policy requires the client to be
+// terminated.
+func (c *FrontendConnection) sendNotificationBatch() error {
+	batch, dropped, ok := c.queue.pop(c.delivery.MaxBatchSize - c.batchSize)
+	if !ok {
+		return errClientCouldNotKeepUp
+	}
+	if dropped > 0 {
+		err := c.sendNotificationsDroppedNotice(dropped)
+		if err != nil {
+			return err
+		}
+	}
+	for _, n := range batch {
+		err := c.sendNotification(n)
+		if err != nil {
+			return err
+		}
+	}
+	c.batchSize += len(batch)
+
+	if c.batchSize >= c.delivery.MaxBatchSize || c.delivery.MaxBatchLatency == 0 {
+		return c.flushNotificationBatch()
+	}
+	if c.batchTimer == nil {
+		c.batchTimer = time.NewTimer(c.delivery.MaxBatchLatency)
+		c.batchTimeout = c.batchTimer.C
+	}
+	return nil
+}
+
+// Flushes the notifications written by sendNotificationBatch to the client.
+func (c *FrontendConnection) flushNotificationBatch() error {
+	c.stopBatchTimer()
+	c.batchSize = 0
+	err := c.FlushStream()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for i, nm := range c.batchLatencies {
+		MetricNotificationDeliveryLatency.Observe(now.Sub(nm.received).Seconds())
+		if !nm.produced.IsZero() {
+			MetricNotificationProducerLatency.Observe(math.Max(now.Sub(nm.produced).Seconds(), 0))
+		}
+		c.batchLatencies[i] = notificationMetadata{}
+	}
+	c.batchLatencies = c.batchLatencies[:0]
+	return nil
+}
+
+func (c *FrontendConnection) stopBatchTimer() {
+	if c.batchTimer != nil {
+		c.batchTimer.Stop()
+		c.batchTimer = nil
+		c.batchTimeout = nil
+	}
 }
 
 func (c *FrontendConnection) setSessionError(err error) {
@@ -639,30 +1200,57 @@ func (c *FrontendConnection) mainLoop(startupParameters map[string]string, dbcfg
 	MetricClientConnections.Inc()
 	defer MetricClientConnections.Dec()
 
+	ctx, span := tracer.Start(context.Background(), "session",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attrClient.String(c.remoteAddr)))
+	defer span.End()
+	c.traceCtx = ctx
+
 	if !c.startup(startupParameters, dbcfg) {
+		span.SetStatus(codes.Error, "startup failed")
 		return
 	}
+	span.SetAttributes(attrDatabase.String(c.database.name), attrUser.String(c.username))
+
+	queueDone := make(chan struct{})
+	defer close(queueDone)
+	c.startNotificationQueue(queueDone)
+
+	c.connectedAt = time.Now()
+	if c.admin != nil {
+		c.admin.clients.Register(c)
+		defer c.admin.clients.Unregister(c)
+	}
 
 	go c.queryProcessingMainLoop()
+	defer c.stopBatchTimer()
 
 mainLoop:
 	for {
 		select {
-		case n := <-c.notify:
-			if len(c.notify) >= cap(c.notify)-1 {
+		case <-c.queue.ready:
+			err := c.sendNotificationBatch()
+			if err == errClientCouldNotKeepUp {
 				MetricSlowClientsTerminated.Inc()
-				c.fatal(errClientCouldNotKeepUp)
+				MetricDatabaseSlowClientsTerminated.WithLabelValues(c.database.name).Inc()
+				c.fatal(err)
+				break mainLoop
+			} else if err != nil {
+				c.setSessionError(err)
 				break mainLoop
 			}
-
-			if err := c.sendNotification(n); err != nil {
+		case <-c.batchTimeout:
+			err := c.flushNotificationBatch()
+			if err != nil {
 				c.setSessionError(err)
 				break mainLoop
 			}
-			MetricNotificationsDispatched.Inc()
 		case _ = <-c.connStatusNotifier:
 			c.fatal(errLostServerConnection)
 			break mainLoop
+		case <-c.killed:
+			c.fatal(errAdminShutdown)
+			break mainLoop
 
 		case resSync, ok := <-c.queryResultCh:
 			if !ok {
@@ -691,23 +1279,50 @@ mainLoop:
 	}
 
 	// Done with this client.  Log the error if necessary.
+	r := c.auditRecord("disconnect")
+	r.Reason = disconnectReason(c.err)
+	if r.Reason == "error" && c.err != nil {
+		r.Reason = "error: " + c.err.Error()
+	}
+	if sqlstate, _, ok := fatalError(c.err); ok {
+		r.SQLState = sqlstate
+		span.SetAttributes(attrSQLState.String(sqlstate))
+		span.SetStatus(codes.Error, c.err.Error())
+	}
+	audit.Record(r)
 	switch c.err {
 	case errLostServerConnection:
 		// Already logged, no need to recite the fact that we're throwing
 		// everyone out.
 	case errGracefulTermination:
-		// This is fine
+		// This is fine, and usually not worth logging
+		if Config.Log.LogDisconnections {
+			c.log.Debugf("client %s disconnected", c)
+		}
 	default:
-		elog.Logf("client %s disconnected: %s\n", c, c.err)
+		if Config.Log.LogDisconnections {
+			logger := c.log
+			if sqlstate, _, ok := fatalError(c.err); ok {
+				logger = logger.WithFields(LogFields{"sqlstate": sqlstate})
+			}
+			logger.Logf("client %s disconnected: %s", c, c.err)
+		}
 	}
 
 	// finally, close all the channels the client was listening on
+	c.patterns.Remove(c.notify)
+	c.listenLock.Lock()
+	c.listenPatterns = nil
+	c.listenLock.Unlock()
 	for channel := range c.listenChannels {
 		err := c.dispatcher.Unlisten(channel, c.notify)
 		if err != nil {
-			elog.Warningf("could not unlisten: %s\n", err)
+			c.log.Warningf("could not unlisten: %s\n", err)
 		}
 		MetricUnlistensExecuted.Inc()
+		MetricChannelListeners.WithLabelValues(channelLabels.Label(channel)).Dec()
 	}
+	c.listenLock.Lock()
 	c.listenChannels = nil
+	c.listenLock.Unlock()
 }
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var initTestMetricsOnce sync.Once
+
+func initTestMetrics(t testing.TB) {
+	initTestMetricsOnce.Do(func() {
+		var cfg PrometheusConfig
+		err := cfg.InitializeMetrics(prometheus.NewRegistry())
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// countingConn is a net.Conn which discards everything written to it, but
+// keeps track of how many times Write was called; each call would be a system
+// call on a real connection.
+type countingConn struct {
+	net.Conn
+
+	writes int
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	c.writes++
+	return len(p), nil
+}
+
+func (c *countingConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (c *countingConn) Close() error {
+	return nil
+}
+
+func BenchmarkNotificationDelivery(b *testing.B) {
+	initTestMetrics(b)
+
+	n := newNotification(&pq.Notification{
+		BePid:   1,
+		Channel: "bench_channel",
+		Extra:   `{"table":"invoices","id":123456}`,
+	}).PqNotification()
+
+	for _, bm := range []struct {
+		name     string
+		delivery DeliveryConfig
+	}{
+		{"Unbatched", DeliveryConfig{MaxBatchSize: 1}},
+		{"Batched", DeliveryConfig{MaxBatchSize: 128}},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			conn := &countingConn{}
+			c := NewFrontendConnection(conn, nil, nil, nil, nil, nil, bm.delivery, nil)
+			c.database = &virtualDatabase{
+				name:             "bench",
+				slowClientPolicy: SlowClientTerminate,
+				queueDepth:       256,
+			}
+			done := make(chan struct{})
+			defer close(done)
+			c.startNotificationQueue(done)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for sent := 0; sent < b.N; {
+				for len(c.queue.items) < c.queue.depth && sent < b.N {
+					c.queue.push(n)
+					sent++
+				}
+				for len(c.queue.items) > 0 {
+					err := c.sendNotificationBatch()
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(conn.writes)/float64(b.N), "writes/op")
+		})
+	}
+}
+
+func TestChannelPrefixIsolation(t *testing.T) {
+	initTestMetrics(t)
+
+	databases := func(prefixes ...string) []interface{} {
+		var array []interface{}
+		for i, prefix := range prefixes {
+			array = append(array, map[string]interface{}{
+				"name":           string(rune('a' + i)),
+				"channel_prefix": prefix,
+			})
+		}
+		return array
+	}
+
+	var c config
+	if readDatabaseSection(&c, databases("a_", "")) == nil {
+		t.Fatalf("a database without a prefix was accepted alongside one with a prefix")
+	}
+	c = config{}
+	if readDatabaseSection(&c, databases("a_", "a_b_")) == nil {
+		t.Fatalf("overlapping prefixes were accepted")
+	}
+	c = config{}
+	err := readDatabaseSection(&c, databases("a_", "b_"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fc := &FrontendConnection{
+		database: &c.Databases[0],
+		log: &Logger{sink: &logSink{
+			minLevel: LOG,
+			output:   streamOutput{io.Discard},
+		}},
+	}
+	var tests = []struct {
+		channel  string
+		expected error
+	}{
+		{"foo", nil},
+		{"b_foo", errChannelPermissionDenied},
+		{strings.Repeat("x", 61), nil},
+		{strings.Repeat("x", 62), errChannelNameTooLong},
+	}
+	for _, ts := range tests {
+		if err := fc.checkChannel(ts.channel); err != ts.expected {
+			t.Errorf("checkChannel(%q) returned %v; expected %v", ts.channel, err, ts.expected)
+		}
+	}
+}
+
+func TestNotificationBatchLatency(t *testing.T) {
+	initTestMetrics(t)
+
+	n := newNotification(&pq.Notification{Channel: "foo"}).PqNotification()
+
+	conn := &countingConn{}
+	c := NewFrontendConnection(conn, nil, nil, nil, nil, nil, DeliveryConfig{MaxBatchSize: 3, MaxBatchLatency: time.Hour}, nil)
+	c.database = &virtualDatabase{
+		name:             "test",
+		slowClientPolicy: SlowClientTerminate,
+		queueDepth:       16,
+	}
+	done := make(chan struct{})
+	defer close(done)
+	c.startNotificationQueue(done)
+
+	push := func(count int) {
+		for i := 0; i < count; i++ {
+			c.queue.push(n)
+		}
+		err := c.sendNotificationBatch()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	latencyCount := func() uint64 {
+		var m dto.Metric
+		err := MetricNotificationDeliveryLatency.(prometheus.Metric).Write(&m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m.GetHistogram().GetSampleCount()
+	}
+	before := latencyCount()
+
+	// a partial batch must not be flushed until the timer fires, and its
+	// latency is not known until then
+	push(2)
+	if conn.writes != 0 || c.batchTimeout == nil {
+		t.Fatalf("partial batch: %d writes, timer %v", conn.writes, c.batchTimeout != nil)
+	}
+	if n := latencyCount() - before; n != 0 {
+		t.Fatalf("latency of %d unflushed notifications observed", n)
+	}
+	// .. but filling it up flushes it right away
+	push(1)
+	if conn.writes != 1 || c.batchTimeout != nil {
+		t.Fatalf("full batch: %d writes, timer %v", conn.writes, c.batchTimeout != nil)
+	}
+	if n := latencyCount() - before; n != 3 {
+		t.Fatalf("latency of %d notifications observed; expected 3", n)
+	}
+
+	push(1)
+	err := c.flushNotificationBatch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.writes != 2 || c.batchTimeout != nil || c.batchSize != 0 {
+		t.Fatalf("timed out batch: %d writes, timer %v, size %d", conn.writes, c.batchTimeout != nil, c.batchSize)
+	}
+}
+
+func TestListenFailureKeepsFilter(t *testing.T) {
+	fc := &FrontendConnection{
+		database:       &virtualDatabase{name: "test", maxChannelsPerClient: 1},
+		queue:          newNotificationQueue(SlowClientTerminate, time.Second, 1, nil),
+		listenChannels: map[string]struct{}{"foo": {}},
+	}
+	filter, err := newPayloadFilter("", filterEquals, "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fc.ListenWhere("bar", filter); err != errTooManyChannels {
+		t.Fatalf("ListenWhere returned %v; expected %v", err, errTooManyChannels)
+	}
+	if f, ok := fc.queue.filters["bar"]; ok {
+		t.Fatalf("filter %+v left in place after LISTEN failed", f)
+	}
+
+	fc.queue.SetFilter("bar", filter)
+	if err := fc.Listen("bar"); err != errTooManyChannels {
+		t.Fatalf("Listen returned %v; expected %v", err, errTooManyChannels)
+	}
+	if fc.queue.filters["bar"] != filter {
+		t.Fatalf("filter was not restored after LISTEN failed")
+	}
+}
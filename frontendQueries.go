@@ -6,6 +6,7 @@ import (
 	fbproto "github.com/uhoh-itsmaciek/femebe/proto"
 
 	"bytes"
+	"fmt"
 )
 
 // These are the different query results
@@ -63,6 +64,39 @@ func NewErrorResponse(sqlstate, errorMessage string) QueryResult {
 	return errorResponse{sqlstate, errorMessage}
 }
 
+// noticeResponse is a NoticeResponse with severity WARNING, followed by
+// another QueryResult (if any).
+type noticeResponse struct {
+	sqlstate string
+	message  string
+	next     QueryResult
+}
+
+func (qr noticeResponse) Respond(f Frontend) error {
+	var message fbcore.Message
+
+	buf := &bytes.Buffer{}
+	buf.WriteByte('S')
+	fbbuf.WriteCString(buf, "WARNING")
+	buf.WriteByte('C')
+	fbbuf.WriteCString(buf, qr.sqlstate)
+	buf.WriteByte('M')
+	fbbuf.WriteCString(buf, qr.message)
+	buf.WriteByte('\x00')
+
+	message.InitFromBytes(fbproto.MsgNoticeResponseN, buf.Bytes())
+
+	err := f.WriteMessage(&message)
+	if err != nil || qr.next == nil {
+		return err
+	}
+	return qr.next.Respond(f)
+}
+
+func NewNoticeResponse(sqlstate, message string, next QueryResult) QueryResult {
+	return noticeResponse{sqlstate, message, next}
+}
+
 // Extended protocol messages.  These don't normally Flush the stream, since
 // that's handled by Sync/Flush messages specifically.
 
@@ -112,13 +146,30 @@ type FrontendQuery interface {
 	Describe() QueryResult
 }
 
+// Returns the ErrorResponse for errors from the Listen* methods of Frontend
+// which are the client's fault, or nil if err is not one of those.
+func listenErrorResponse(channel string, err error) QueryResult {
+	switch err {
+	case errChannelPermissionDenied:
+		return NewErrorResponse("42501", fmt.Sprintf("permission denied for channel %s", channel))
+	case errTooManyChannels, errTooManyUpstreamChannels:
+		return NewErrorResponse("54000", err.Error())
+	case errChannelNameTooLong:
+		return NewErrorResponse("42622", fmt.Sprintf("channel name %q is too long", channel))
+	default:
+		return nil
+	}
+}
+
 type listenRequest struct {
 	channel string
 }
 
 func (q listenRequest) Process(fe Frontend) (QueryResult, error) {
 	err := fe.Listen(q.channel)
-	if err != nil {
+	if errorResponse := listenErrorResponse(q.channel, err); errorResponse != nil {
+		return errorResponse, nil
+	} else if err != nil {
 		// This should probably never happen, right?  It's OK to just kill the
 		// frontend?
 		return nil, err
@@ -166,6 +217,255 @@ func NewWildcardUnlistenRequest() FrontendQuery {
 	return unlistenRequest{"", true}
 }
 
+type listenFromRequest struct {
+	channel string
+	seq     uint64
+}
+
+func (q listenFromRequest) Process(fe Frontend) (QueryResult, error) {
+	gap, err := fe.ListenFrom(q.channel, q.seq)
+	if errorResponse := listenErrorResponse(q.channel, err); errorResponse != nil {
+		return errorResponse, nil
+	} else if err == errNoReplayBuffer {
+		return NewErrorResponse("55000", fmt.Sprintf("channel %q does not have a replay buffer", q.channel)), nil
+	} else if err != nil {
+		// XXX see ListenRequest.Process
+		return nil, err
+	}
+	if gap {
+		message := fmt.Sprintf("some notifications on channel %q after sequence number %d are no longer available", q.channel, q.seq)
+		return NewNoticeResponse("01000", message, commandComplete("LISTEN")), nil
+	}
+	return commandComplete("LISTEN"), nil
+}
+
+func (q listenFromRequest) Describe() QueryResult {
+	return NewNoData()
+}
+
+func NewListenFromRequest(channel string, seq uint64) FrontendQuery {
+	return listenFromRequest{channel, seq}
+}
+
+type listenWhereRequest struct {
+	channel string
+	key     string
+	op      payloadFilterOperator
+	value   string
+}
+
+func (q listenWhereRequest) Process(fe Frontend) (QueryResult, error) {
+	filter, err := newPayloadFilter(q.key, q.op, q.value)
+	if err != nil {
+		if q.op == filterLike {
+			return NewErrorResponse("22025", err.Error()), nil
+		}
+		return NewErrorResponse("2201B", err.Error()), nil
+	}
+	err = fe.ListenWhere(q.channel, filter)
+	if errorResponse := listenErrorResponse(q.channel, err); errorResponse != nil {
+		return errorResponse, nil
+	} else if err != nil {
+		// XXX see ListenRequest.Process
+		return nil, err
+	}
+	return commandComplete("LISTEN"), nil
+}
+
+func (q listenWhereRequest) Describe() QueryResult {
+	return NewNoData()
+}
+
+func NewListenWhereRequest(channel, key string, op payloadFilterOperator, value string) FrontendQuery {
+	return listenWhereRequest{channel, key, op, value}
+}
+
+type listenConsumerRequest struct {
+	channel  string
+	consumer string
+}
+
+func (q listenConsumerRequest) Process(fe Frontend) (QueryResult, error) {
+	gap, err := fe.ListenConsumer(q.channel, q.consumer)
+	if errorResponse := listenErrorResponse(q.channel, err); errorResponse != nil {
+		return errorResponse, nil
+	} else if err == errNoDurableLog || err == errConsumerMismatch {
+		return NewErrorResponse("55000", err.Error()), nil
+	} else if err != nil {
+		// XXX see ListenRequest.Process
+		return nil, err
+	}
+	if gap {
+		message := fmt.Sprintf("some notifications on channel %q not yet acknowledged by consumer %q are no longer available", q.channel, q.consumer)
+		return NewNoticeResponse("01000", message, commandComplete("LISTEN")), nil
+	}
+	return commandComplete("LISTEN"), nil
+}
+
+func (q listenConsumerRequest) Describe() QueryResult {
+	return NewNoData()
+}
+
+func NewListenConsumerRequest(channel, consumer string) FrontendQuery {
+	return listenConsumerRequest{channel, consumer}
+}
+
+type ackRequest struct {
+	offset uint32
+}
+
+func (q ackRequest) Process(fe Frontend) (QueryResult, error) {
+	err := fe.Acknowledge(q.offset)
+	if err == errNoDurableLog || err == errNoConsumer {
+		return NewErrorResponse("55000", err.Error()), nil
+	} else if err == errOffsetNotInLog || err == errOffsetBackwards {
+		return NewErrorResponse("22023", err.Error()), nil
+	} else if err != nil {
+		elog.Errorf("could not store consumer offset: %s", err)
+		return NewErrorResponse("58030", "could not store consumer offset"), nil
+	}
+	return commandComplete("ACK"), nil
+}
+
+func (q ackRequest) Describe() QueryResult {
+	return NewNoData()
+}
+
+func NewAckRequest(offset uint32) FrontendQuery {
+	return ackRequest{offset}
+}
+
+type listenPatternRequest struct {
+	pattern string
+}
+
+func (q listenPatternRequest) Process(fe Frontend) (QueryResult, error) {
+	pattern, err := newLikePattern(q.pattern)
+	if err != nil {
+		return NewErrorResponse("22025", err.Error()), nil
+	}
+	err = fe.ListenPattern(pattern)
+	if err != nil {
+		// XXX see ListenRequest.Process
+		return nil, err
+	}
+	return commandComplete("LISTEN"), nil
+}
+
+func (q listenPatternRequest) Describe() QueryResult {
+	return NewNoData()
+}
+
+func NewListenPatternRequest(pattern string) FrontendQuery {
+	return listenPatternRequest{pattern}
+}
+
+type unlistenPatternRequest struct {
+	pattern string
+}
+
+func (q unlistenPatternRequest) Process(fe Frontend) (QueryResult, error) {
+	err := fe.UnlistenPattern(q.pattern)
+	if err != nil {
+		// XXX see ListenRequest.Process
+		return nil, err
+	}
+	return commandComplete("UNLISTEN"), nil
+}
+
+func (q unlistenPatternRequest) Describe() QueryResult {
+	return NewNoData()
+}
+
+func NewUnlistenPatternRequest(pattern string) FrontendQuery {
+	return unlistenPatternRequest{pattern}
+}
+
+type showRequest struct {
+	what string
+}
+
+func (q showRequest) Process(fe Frontend) (QueryResult, error) {
+	admin := fe.AdminConsole()
+	if admin == nil {
+		return NewErrorResponse("42501", "SHOW is only allowed in the admin console"), nil
+	}
+	rows, err := admin.Show(q.what)
+	if err != nil {
+		return nil, err
+	}
+	return NewDataRows(rows, "SHOW"), nil
+}
+
+func (q showRequest) Describe() QueryResult {
+	return textColumns(adminShowColumns[q.what]...)
+}
+
+func NewShowRequest(what string) FrontendQuery {
+	return showRequest{what}
+}
+
+type killRequest struct {
+	id int64
+}
+
+func (q killRequest) Process(fe Frontend) (QueryResult, error) {
+	admin := fe.AdminConsole()
+	if admin == nil {
+		return NewErrorResponse("42501", "KILL is only allowed in the admin console"), nil
+	}
+	err := admin.Kill(q.id)
+	if err == errNoSuchClient {
+		return NewErrorResponse("42704", fmt.Sprintf("client %d does not exist", q.id)), nil
+	} else if err != nil {
+		return nil, err
+	}
+	return commandComplete("KILL"), nil
+}
+
+func (q killRequest) Describe() QueryResult {
+	return NewNoData()
+}
+
+func NewKillRequest(id int64) FrontendQuery {
+	return killRequest{id}
+}
+
+// rejectedQuery is a query which is not allowed in the database the client
+// is connected to.  See RestrictQuery.
+type rejectedQuery struct {
+	sqlstate     string
+	errorMessage string
+}
+
+func (q rejectedQuery) Process(fe Frontend) (QueryResult, error) {
+	return NewErrorResponse(q.sqlstate, q.errorMessage), nil
+}
+
+func (q rejectedQuery) Describe() QueryResult {
+	return NewNoData()
+}
+
+// Replaces q with a query returning an error if it's not allowed in the
+// database the client is connected to.  The admin console only accepts SHOW,
+// KILL and the queries client libraries send on their own, and SHOW and KILL
+// are not accepted anywhere else.  This has to be done before q.Describe is
+// called, since SHOW describes a result set even if it's not allowed.
+func RestrictQuery(q FrontendQuery, admin bool) FrontendQuery {
+	switch q.(type) {
+	case showRequest, killRequest:
+		if !admin {
+			return rejectedQuery{"42501", "SHOW and KILL are only allowed in the admin console"}
+		}
+	case emptyQuery, trivialSelect, nopSetCommand:
+	default:
+		if admin {
+			return rejectedQuery{"0A000", "the admin console only supports SHOW and KILL"}
+		}
+	}
+	return q
+}
+
 type emptyQuery struct {
 }
 
@@ -186,54 +486,85 @@ func NewEmptyQuery() FrontendQuery {
 // FrontendQuery.Describe) is a RowDescription.  See
 // FrontendConnection.queryProcessingMainLoop.
 func DescriptionIsRowDescription(d QueryResult) bool {
-	_, ok := d.(trivialSelectResultDescription)
+	_, ok := d.(rowDescription)
 	return ok
 }
 
-type trivialSelectResultDescription struct{}
+// rowDescription is a RowDescription describing the columns of a result set.
+type rowDescription []fbproto.FieldDescription
 
-func (d trivialSelectResultDescription) Respond(f Frontend) error {
+func (d rowDescription) Respond(f Frontend) error {
 	var msg fbcore.Message
 
-	tupleDesc := fbproto.FieldDescription{
-		Name:       "?column?",
-		TableOid:   0,
-		TableAttNo: 0,
-		TypeOid:    23,
-		TypLen:     4,
-		Atttypmod:  0,
-		Format:     0,
-	}
-	fbproto.InitRowDescription(&msg, []fbproto.FieldDescription{tupleDesc})
+	fbproto.InitRowDescription(&msg, d)
 	return f.WriteMessage(&msg)
 }
 
-type trivialSelectResult struct {}
+// Returns a rowDescription of columns of type text.
+func textColumns(names ...string) rowDescription {
+	d := make(rowDescription, len(names))
+	for i, name := range names {
+		d[i] = fbproto.FieldDescription{
+			Name:       name,
+			TableOid:   0,
+			TableAttNo: 0,
+			TypeOid:    25,
+			TypLen:     -1,
+			Atttypmod:  -1,
+			Format:     0,
+		}
+	}
+	return d
+}
+
+// dataRows is a DataRow for each row of a result set, followed by a
+// CommandComplete.  All values are sent in text format, and none of them can
+// be NULL.
+type dataRows struct {
+	rows [][]string
+	tag  string
+}
 
-func (r trivialSelectResult) Respond(f Frontend) error {
+func (r dataRows) Respond(f Frontend) error {
 	var msg fbcore.Message
 
-	buf := &bytes.Buffer{}
-	fbbuf.WriteInt16(buf, 1)
-	fbbuf.WriteInt32(buf, 1)
-	buf.WriteByte('1')
-	msg.InitFromBytes(fbproto.MsgDataRowD, buf.Bytes())
-	err := f.WriteMessage(&msg)
-	if err != nil {
-		return err
+	for _, row := range r.rows {
+		buf := &bytes.Buffer{}
+		fbbuf.WriteInt16(buf, int16(len(row)))
+		for _, value := range row {
+			fbbuf.WriteInt32(buf, int32(len(value)))
+			buf.WriteString(value)
+		}
+		msg.InitFromBytes(fbproto.MsgDataRowD, buf.Bytes())
+		err := f.WriteMessage(&msg)
+		if err != nil {
+			return err
+		}
 	}
-	return commandComplete("SELECT").Respond(f)
+	return commandComplete(r.tag).Respond(f)
+}
+
+func NewDataRows(rows [][]string, tag string) QueryResult {
+	return dataRows{rows, tag}
 }
 
 type trivialSelect struct {
 }
 
 func (q trivialSelect) Process(fe Frontend) (QueryResult, error) {
-	return trivialSelectResult{}, nil
+	return NewDataRows([][]string{{"1"}}, "SELECT"), nil
 }
 
 func (q trivialSelect) Describe() QueryResult {
-	return trivialSelectResultDescription{}
+	return rowDescription{{
+		Name:       "?column?",
+		TableOid:   0,
+		TableAttNo: 0,
+		TypeOid:    23,
+		TypLen:     4,
+		Atttypmod:  0,
+		Format:     0,
+	}}
 }
 
 func NewTrivialSelect() FrontendQuery {
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HTTPAPIConfig specifies the HTTP API, which exposes the information and
+// operations of the admin console as JSON for automation.
+type HTTPAPIConfig struct {
+	Enabled bool
+	Listen  ListenConfig
+	// every request must carry this in an "Authorization: Bearer" header
+	Token string
+}
+
+type apiClient struct {
+	ID          int64     `json:"id"`
+	RemoteAddr  string    `json:"remote_addr"`
+	Database    string    `json:"database"`
+	User        string    `json:"user"`
+	ConnectedAt time.Time `json:"connected_at"`
+	Channels    []string  `json:"channels"`
+	Patterns    []string  `json:"patterns"`
+	Queued      int       `json:"queued"`
+	Consumer    string    `json:"consumer,omitempty"`
+}
+
+type apiChannel struct {
+	Channel   string `json:"channel"`
+	Listeners int    `json:"listeners"`
+	Upstream  bool   `json:"upstream"`
+}
+
+type apiUpstream struct {
+	Connected      bool       `json:"connected"`
+	StateChangedAt *time.Time `json:"state_changed_at"`
+	Reconnects     int        `json:"reconnects"`
+	Channels       int        `json:"channels"`
+	LastError      string     `json:"last_error,omitempty"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+type httpAPI struct {
+	token string
+	admin *adminConsole
+}
+
+// Returns the handler serving the HTTP API.
+func newHTTPAPIHandler(token string, admin *adminConsole) http.Handler {
+	api := &httpAPI{token, admin}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/clients", api.listClients)
+	mux.HandleFunc("DELETE /api/clients/{id}", api.killClient)
+	mux.HandleFunc("GET /api/channels", api.listChannels)
+	mux.HandleFunc("GET /api/upstream", api.upstreamStatus)
+	mux.HandleFunc("POST /api/reload", api.reload)
+	return api.authenticate(mux)
+}
+
+func (cfg *HTTPAPIConfig) Setup(admin *adminConsole) error {
+	s := &http.Server{
+		Handler: newHTTPAPIHandler(cfg.Token, admin),
+	}
+	l, err := cfg.Listen.Listen()
+	if err != nil {
+		return err
+	}
+	go func() {
+		elog.Fatalf("HTTP API endpoint failed: %s", s.Serve(l))
+	}()
+	return nil
+}
+
+func (api *httpAPI) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(api.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="allas"`)
+			writeJSON(w, http.StatusUnauthorized, apiError{"invalid or missing bearer token"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (api *httpAPI) session(r *http.Request) *adminSession {
+	return &adminSession{api.admin, auditActor{client: r.RemoteAddr, user: "http_api"}}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		elog.Warningf("could not write HTTP API response: %s", err)
+	}
+}
+
+func (api *httpAPI) listClients(w http.ResponseWriter, r *http.Request) {
+	clients := []apiClient{}
+	for _, c := range api.admin.clients.List() {
+		info := c.info()
+		clients = append(clients, apiClient{
+			ID:          info.id,
+			RemoteAddr:  info.addr,
+			Database:    info.database,
+			User:        info.user,
+			ConnectedAt: info.connectedAt,
+			Channels:    append([]string{}, info.channels...),
+			Patterns:    append([]string{}, info.patterns...),
+			Queued:      info.queued,
+			Consumer:    info.consumer,
+		})
+	}
+	writeJSON(w, http.StatusOK, clients)
+}
+
+func (api *httpAPI) killClient(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{"invalid client id"})
+		return
+	}
+	err = api.session(r).Kill(id)
+	if err == errNoSuchClient {
+		writeJSON(w, http.StatusNotFound, apiError{err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (api *httpAPI) listChannels(w http.ResponseWriter, r *http.Request) {
+	channels := []apiChannel{}
+	for _, info := range api.admin.channels() {
+		channels = append(channels, apiChannel{info.channel, info.listeners, info.upstream})
+	}
+	writeJSON(w, http.StatusOK, channels)
+}
+
+func (api *httpAPI) upstreamStatus(w http.ResponseWriter, r *http.Request) {
+	connected, changedAt, reconnects, lastError := api.admin.upstream.Snapshot()
+	status := apiUpstream{
+		Connected:  connected,
+		Reconnects: reconnects,
+		Channels:   api.admin.numUpstreamChannels(),
+		LastError:  lastError,
+	}
+	if !changedAt.IsZero() {
+		status.StateChangedAt = &changedAt
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (api *httpAPI) reload(w http.ResponseWriter, r *http.Request) {
+	err := api.session(r).Reload()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, apiError{err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
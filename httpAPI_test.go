@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHTTPAPI(t *testing.T) {
+	admin := newAdminConsole(&Config, "")
+	handler := newHTTPAPIHandler("s3cret", admin)
+
+	var tests = []struct {
+		method string
+		path   string
+		token  string
+		status int
+		body   string
+	}{
+		{"GET", "/api/clients", "", http.StatusUnauthorized, `{"error":"invalid or missing bearer token"}`},
+		{"GET", "/api/clients", "wrong", http.StatusUnauthorized, `{"error":"invalid or missing bearer token"}`},
+		{"GET", "/api/clients", "s3cret", http.StatusOK, `[]`},
+		{"GET", "/api/channels", "s3cret", http.StatusOK, `[]`},
+		{"GET", "/api/upstream", "s3cret", http.StatusOK, `{"connected":false,"state_changed_at":null,"reconnects":0,"channels":0}`},
+		{"DELETE", "/api/clients/1", "s3cret", http.StatusNotFound, `{"error":"no such client"}`},
+		{"DELETE", "/api/clients/x", "s3cret", http.StatusBadRequest, `{"error":"invalid client id"}`},
+		{"POST", "/api/clients", "s3cret", http.StatusMethodNotAllowed, ""},
+	}
+	for _, ts := range tests {
+		req := httptest.NewRequest(ts.method, ts.path, nil)
+		if ts.token != "" {
+			req.Header.Set("Authorization", "Bearer "+ts.token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != ts.status {
+			t.Errorf("%s %s: status %d; expected %d", ts.method, ts.path, rec.Code, ts.status)
+		}
+		if ts.body != "" && strings.TrimSpace(rec.Body.String()) != ts.body {
+			t.Errorf("%s %s: body %q; expected %q", ts.method, ts.path, rec.Body.String(), ts.body)
+		}
+	}
+}
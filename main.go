@@ -3,7 +3,11 @@ package main
 import (
 	"github.com/johto/notifyutils/notifydispatcher"
 	"github.com/lib/pq"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
+	"context"
+	"errors"
 	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
 	"os"
@@ -17,15 +21,55 @@ import (
 type pqListenerWrapper struct {
 	l *pq.Listener
 	ch chan *pq.Notification
+	patterns *patternSubscriptions
+	coalescer *coalescer
+	fetcher *payloadFetcher
+	transformers []TransformerConfig
+	// JSON field of payloads carrying the time the producer sent them; empty
+	// if not configured
+	producerTimestampField string
+	replay *replayBuffers
+	durableLog *durableLog
+	// notifications on their way to deliveryGoroutine, in the order they
+	// were received from the server; nil signals a lost connection
+	ready chan *inflightNotification
+
+	// zero means no limit
+	maxChannels int
+	channelsLock sync.Mutex
+	channels map[string]struct{}
 
 	inputChannelSaturationRatio *prometheus.Desc
 	dispatcherChannelSaturationRatio *prometheus.Desc
+	upstreamChannels *prometheus.Desc
 }
 
-func newPqListenerWrapper(l *pq.Listener) (*pqListenerWrapper, error) {
+var errTooManyUpstreamChannels = errors.New("too many channels listened on in the server")
+
+// A notification on its way through pqListenerWrapper, with the span covering
+// its processing.
+type inflightNotification struct {
+	n    *notification
+	span trace.Span
+	// closed once the payload has been fetched; nil if there's nothing to
+	// fetch
+	fetched chan struct{}
+}
+
+func newPqListenerWrapper(l *pq.Listener, patterns *patternSubscriptions, coalescer *coalescer, fetcher *payloadFetcher, transformers []TransformerConfig, producerTimestampField string, replay *replayBuffers, durableLog *durableLog, maxChannels int) (*pqListenerWrapper, error) {
 	w := &pqListenerWrapper{
 		l: l,
 		ch: make(chan *pq.Notification, 4),
+		patterns: patterns,
+		coalescer: coalescer,
+		fetcher: fetcher,
+		transformers: transformers,
+		producerTimestampField: producerTimestampField,
+		replay: replay,
+		durableLog: durableLog,
+		ready: make(chan *inflightNotification, 64),
+		maxChannels: maxChannels,
+		channels: make(map[string]struct{}),
 	}
 
 	w.inputChannelSaturationRatio = prometheus.NewDesc(
@@ -41,17 +85,26 @@ func newPqListenerWrapper(l *pq.Listener) (*pqListenerWrapper, error) {
 		nil,
 	)
 
+	w.upstreamChannels = prometheus.NewDesc(
+		"allas_upstream_channels",
+		"the number of channels currently LISTENed on the PostgreSQL server",
+		nil,
+		nil,
+	)
+
 	err := Config.Prometheus.RegisterMetricsCollector(w)
 	if err != nil {
 		return nil, err
 	}
-	go w.workerGoroutine()
+	go w.workerGoroutine(l.NotificationChannel())
+	go w.deliveryGoroutine()
 	return w, nil
 }
 
 func (w *pqListenerWrapper) Describe(ch chan<- *prometheus.Desc) {
 	ch <- w.inputChannelSaturationRatio
 	ch <- w.dispatcherChannelSaturationRatio
+	ch <- w.upstreamChannels
 }
 
 func (w *pqListenerWrapper) Collect(ch chan<- prometheus.Metric) {
@@ -59,24 +112,117 @@ func (w *pqListenerWrapper) Collect(ch chan<- prometheus.Metric) {
 	ch <- prometheus.MustNewConstMetric(w.inputChannelSaturationRatio, prometheus.GaugeValue, inputChSaturation)
 	dispatcherChSaturation := float64(len(w.ch)) / float64(cap(w.ch))
 	ch <- prometheus.MustNewConstMetric(w.dispatcherChannelSaturationRatio, prometheus.GaugeValue, dispatcherChSaturation)
-
+	ch <- prometheus.MustNewConstMetric(w.upstreamChannels, prometheus.GaugeValue, float64(len(w.Channels())))
 }
 
-func (w *pqListenerWrapper) workerGoroutine() {
-	input := w.l.NotificationChannel()
+// Drains the pq.Listener.  Anything which might block for a while, such as
+// fetching payloads, happens elsewhere so that the listener's buffer doesn't
+// fill up.  Payloads are fetched concurrently, but the notifications are
+// passed on to deliveryGoroutine in the order they arrived in, so replay
+// sequence numbers and durable log offsets follow the server's order, and a
+// lost connection is only reported after everything received before it.
+func (w *pqListenerWrapper) workerGoroutine(input <-chan *pq.Notification) {
 	for {
 		m := <-input
+		if m == nil {
+			w.ready <- nil
+			continue
+		}
 		MetricNotificationsReceived.Inc()
-		w.ch <- m
+		MetricChannelNotificationsReceived.WithLabelValues(channelLabels.Label(m.Channel)).Inc()
+
+		n := newNotification(m)
+		_, span := tracer.Start(context.Background(), "notification",
+			trace.WithTimestamp(n.received),
+			trace.WithSpanKind(trace.SpanKindConsumer),
+			trace.WithAttributes(attrChannel.String(n.Channel)))
+		n.span = span.SpanContext()
+		if w.coalescer.Suppress(n) {
+			MetricNotificationsCoalesced.Inc()
+			span.SetAttributes(attribute.Bool("allas.coalesced", true))
+			span.End()
+			continue
+		}
+		inflight := &inflightNotification{n: n, span: span}
+		if w.fetcher != nil && w.fetcher.Matches(n.Channel) {
+			inflight.fetched = make(chan struct{})
+			w.fetcher.Submit(n, func(*notification) {
+				close(inflight.fetched)
+			})
+		}
+		w.ready <- inflight
 	}
 }
 
+// Delivers the notifications received by workerGoroutine to the dispatcher.
+// This is the only goroutine calling the transformers.
+func (w *pqListenerWrapper) deliveryGoroutine() {
+	for inflight := range w.ready {
+		if inflight == nil {
+			w.ch <- nil
+			continue
+		}
+		if inflight.fetched != nil {
+			<-inflight.fetched
+		}
+		n, span := inflight.n, inflight.span
+		if w.producerTimestampField != "" {
+			n.produced, _ = parseProducerTimestamp(n.Extra, w.producerTimestampField)
+		}
+		applyTransformers(w.transformers, n)
+		if w.durableLog != nil {
+			err := w.durableLog.Append(n)
+			if err != nil {
+				elog.Errorf("could not write notification to the durable log: %s", err)
+			}
+		}
+		w.replay.Append(n)
+		pn := n.PqNotification()
+		w.patterns.Dispatch(pn)
+		w.ch <- pn
+		span.End()
+	}
+}
+
+// NotifyDispatcher only calls Listen for channels which nobody is listening
+// on yet, and passes any error we return on to everyone waiting for the
+// channel to become active, so this is where we enforce maxChannels.
 func (w *pqListenerWrapper) Listen(channel string) error {
-	return w.l.Listen(channel)
+	w.channelsLock.Lock()
+	defer w.channelsLock.Unlock()
+
+	_, ok := w.channels[channel]
+	if !ok && w.maxChannels > 0 && len(w.channels) >= w.maxChannels {
+		return errTooManyUpstreamChannels
+	}
+	err := w.l.Listen(channel)
+	if err == nil || err == pq.ErrChannelAlreadyOpen {
+		w.channels[channel] = struct{}{}
+	}
+	return err
 }
 
 func (w *pqListenerWrapper) Unlisten(channel string) error {
-	return w.l.Unlisten(channel)
+	w.channelsLock.Lock()
+	defer w.channelsLock.Unlock()
+
+	err := w.l.Unlisten(channel)
+	if err == nil || err == pq.ErrChannelNotOpen {
+		delete(w.channels, channel)
+	}
+	return err
+}
+
+// Returns the channels currently listened on in the server.
+func (w *pqListenerWrapper) Channels() []string {
+	w.channelsLock.Lock()
+	defer w.channelsLock.Unlock()
+
+	channels := make([]string, 0, len(w.channels))
+	for channel := range w.channels {
+		channels = append(channels, channel)
+	}
+	return channels
 }
 
 func (w *pqListenerWrapper) NotificationChannel() <-chan *pq.Notification {
@@ -84,11 +230,41 @@ func (w *pqListenerWrapper) NotificationChannel() <-chan *pq.Notification {
 }
 
 // runs in its own goroutine
-func listenerPinger(listener *pq.Listener) {
-   for {
-	   time.Sleep(60 * time.Second)
-	   _ = listener.Ping()
-   }
+func listenerPinger(listener *pq.Listener, cfg UpstreamConfig, dialer *upstreamDialer) {
+	for {
+		time.Sleep(cfg.PingInterval)
+
+		start := time.Now()
+		result := make(chan error, 1)
+		go func() {
+			result <- listener.Ping()
+		}()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if cfg.PingTimeout > 0 {
+			timer = time.NewTimer(cfg.PingTimeout)
+			timeout = timer.C
+		}
+
+		select {
+		case err := <-result:
+			if err != nil {
+				MetricUpstreamPingFailures.Inc()
+			} else {
+				MetricUpstreamPingDuration.Observe(time.Since(start).Seconds())
+			}
+		case <-timeout:
+			elog.Warningf("Listener: ping timed out after %s, closing connection", cfg.PingTimeout)
+			MetricUpstreamPingTimeouts.Inc()
+			dialer.CloseConnection()
+			// wait for the ping to fail
+			<-result
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
 }
 
 func printUsage() {
@@ -115,8 +291,21 @@ func main() {
 	if err != nil {
 		elog.Fatalf("error while reading configuration file: %s", err)
 	}
-	if len(Config.Databases) == 0 {
-		elog.Fatalf("at least one database must be configured")
+	err = ConfigureErrorLog(Config.Log)
+	if err != nil {
+		elog.Fatalf("could not set up logging: %s", err)
+	}
+	if Config.Tracing.Enabled {
+		err = setupTracing(Config.Tracing)
+		if err != nil {
+			elog.Fatalf("could not set up tracing: %s", err)
+		}
+	}
+	if Config.AuditLog.Enabled {
+		audit, err = openAuditLog(Config.AuditLog)
+		if err != nil {
+			elog.Fatalf("could not open audit log: %s", err)
+		}
 	}
 
 	l, err := Config.Listen.Listen()
@@ -128,51 +317,186 @@ func main() {
 	if err != nil {
 		elog.Fatalf("Prometheus exporter setup failed: %s", err)
 	}
+	if Config.Debug.Enabled {
+		err = Config.Debug.Setup()
+		if err != nil {
+			elog.Fatalf("debug listener setup failed: %s", err)
+		}
+	}
+
+	// make sure pq.Listener doesn't pick up any env variables
+	os.Clearenv()
+
+	clientConnectionString := fmt.Sprintf("fallback_application_name=allas %s", Config.ClientConnInfo)
+
+	var serverParams *serverParameters
+	if Config.ForwardServerParameters {
+		connector, err := pq.NewConnector(clientConnectionString)
+		if err != nil {
+			elog.Fatalf("invalid connection string: %s", err)
+		}
+		connector.Dialer(Config.Upstream.newDialer())
+		serverParams = newServerParameters(connector)
+	}
+
+	var fetcher *payloadFetcher
+	if len(Config.PayloadFetch) > 0 {
+		connector, err := pq.NewConnector(clientConnectionString)
+		if err != nil {
+			elog.Fatalf("invalid connection string: %s", err)
+		}
+		connector.Dialer(Config.Upstream.newDialer())
+		fetcher = newPayloadFetcher(connector, Config.PayloadFetch)
+	}
+
+	if Config.Metrics.Enabled {
+		channelLabels = newChannelLabeler(Config.Metrics)
+	}
+	admin := newAdminConsole(&Config, os.Args[1])
+	err = Config.Prometheus.RegisterMetricsCollector(admin.upstream)
+	if err != nil {
+		elog.Fatalf("%s", err)
+	}
+
+	var readinessConnector *pq.Connector
+	if Config.Readiness.Enabled {
+		readinessConnector, err = pq.NewConnector(clientConnectionString)
+		if err != nil {
+			elog.Fatalf("invalid connection string: %s", err)
+		}
+		readinessConnector.Dialer(Config.Upstream.newDialer())
+	}
+	readiness := newReadinessChecker(Config.Readiness, admin.upstream, readinessConnector)
+	Config.Prometheus.HandleFunc("/healthz", readiness.serveHealth)
+	Config.Prometheus.HandleFunc("/readyz", readiness.serveReady)
 
 	var m sync.Mutex
 	var connStatusNotifier chan struct{}
+	// incremented whenever the connection is established or lost, so that a
+	// refresh of the server parameters which completes after the connection
+	// has been lost again doesn't let clients in
+	var connGeneration int
+
+	// pq.Listener's own reconnect logic doesn't support jitter, so we do the
+	// waiting in the event callback instead; see the call to NewDialListener
+	// below.
+	backoff := &upstreamBackoff{cfg: Config.Upstream}
+	waitBeforeReconnect := func() {
+		delay := backoff.Next()
+		MetricUpstreamReconnectDelay.Observe(delay.Seconds())
+		time.Sleep(delay)
+	}
 
 	listenerStateChange := func(ev pq.ListenerEventType, err error) {
 		switch ev {
 		case pq.ListenerEventConnectionAttemptFailed:
 			elog.Warningf("Listener: could not connect to the database: %s", err.Error())
+			MetricUpstreamConnectionAttemptsFailed.Inc()
+			admin.upstream.SetDisconnected(err)
+			waitBeforeReconnect()
 
 		case pq.ListenerEventDisconnected:
 			elog.Warningf("Listener: lost connection to the database: %s", err.Error())
+			MetricUpstreamDisconnects.Inc()
+			admin.upstream.SetDisconnected(err)
 			m.Lock()
-			close(connStatusNotifier)
-			connStatusNotifier = nil
+			connGeneration++
+			if connStatusNotifier != nil {
+				close(connStatusNotifier)
+				connStatusNotifier = nil
+			}
 			m.Unlock()
+			waitBeforeReconnect()
 
 		case pq.ListenerEventReconnected,
 			pq.ListenerEventConnected:
 			elog.Logf("Listener: connected to the database")
+			if ev == pq.ListenerEventReconnected {
+				MetricUpstreamReconnects.Inc()
+			}
+			admin.upstream.SetConnected(ev == pq.ListenerEventReconnected)
+			backoff.Reset()
+
 			m.Lock()
-			connStatusNotifier = make(chan struct{})
+			connGeneration++
+			generation := connGeneration
+			if serverParams == nil {
+				connStatusNotifier = make(chan struct{})
+			}
 			m.Unlock()
+
+			// Refresh the parameters before letting clients in, so that
+			// nobody sees the values of the server we were connected to
+			// before.  This can take a while, so don't hold up the
+			// listener.
+			if serverParams != nil {
+				go func() {
+					err := serverParams.Refresh()
+					if err != nil {
+						elog.Warningf("could not fetch server parameters: %s", err)
+						serverParams.Clear()
+					}
+					m.Lock()
+					if connGeneration == generation {
+						connStatusNotifier = make(chan struct{})
+					}
+					m.Unlock()
+				}()
+			}
 		}
 	}
 
-	// make sure pq.Listener doesn't pick up any env variables
-	os.Clearenv()
-
-	clientConnectionString := fmt.Sprintf("fallback_application_name=allas %s", Config.ClientConnInfo)
-	listener := pq.NewListener(
+	dialer := Config.Upstream.newDialer()
+	listener := pq.NewDialListener(
+		dialer,
 		clientConnectionString,
-		250*time.Millisecond, 3*time.Second,
+		time.Millisecond, time.Millisecond,
 		listenerStateChange,
 	)
-	listenerWrapper, err := newPqListenerWrapper(listener)
+	patterns := newPatternSubscriptions()
+	replay := newReplayBuffers(Config.Replay)
+	var durableLog *durableLog
+	if Config.DurableLog.Enabled {
+		durableLog, err = openDurableLog(Config.DurableLog)
+		if err != nil {
+			elog.Fatalf("could not open durable log: %s", err)
+		}
+	}
+	listenerWrapper, err := newPqListenerWrapper(listener, patterns, newCoalescer(Config.Coalesce), fetcher, Config.Transformers, Config.ProducerTimestampField, replay, durableLog, Config.Upstream.MaxChannels)
 	if err != nil {
 		elog.Fatalf("%s", err)
 	}
+	admin.listener = listenerWrapper
+
+	if Config.HTTPAPI.Enabled {
+		err = Config.HTTPAPI.Setup(admin)
+		if err != nil {
+			elog.Fatalf("HTTP API setup failed: %s", err)
+		}
+	}
 	nd := notifydispatcher.NewNotifyDispatcher(listenerWrapper)
 	nd.SetBroadcastOnConnectionLoss(false)
 	nd.SetSlowReaderEliminationStrategy(notifydispatcher.NeglectSlowReaders)
 
+	// Keep the configured channels LISTENed on for pattern subscribers.  The
+	// dispatcher never blocks, so nobody needs to read from this channel.
+	// Listen waits for the connection to be established, so don't hold up
+	// accepting (and rejecting) clients while doing this.
+	upstreamChannelSink := make(chan *pq.Notification)
+	go func() {
+		for _, channel := range Config.Upstream.Channels {
+			err := nd.Listen(channel, upstreamChannelSink)
+			if err != nil {
+				elog.Fatalf("could not listen on channel %q: %s", channel, err)
+			}
+		}
+	}()
+
+	readiness.Start(nd)
+
 	// We don't strictly speaking need to be pinging the server; this is a
 	// workaround for PostgreSQL BUG #14830.
-	go listenerPinger(listener)
+	go listenerPinger(listener, Config.Upstream, dialer)
 
 	for {
 		c, err := l.Accept()
@@ -182,19 +506,22 @@ func main() {
 
 		Config.Listen.MaybeEnableKeepAlive(c)
 
-		var myConnStatusNotifier chan struct{}
-
+		// nil if we're not connected to the server; startup only lets
+		// clients of the admin console through in that case
 		m.Lock()
-		if connStatusNotifier == nil {
-			m.Unlock()
-			go RejectFrontendConnection(c)
-			continue
-		} else {
-			myConnStatusNotifier = connStatusNotifier
-		}
+		myConnStatusNotifier := connStatusNotifier
 		m.Unlock()
 
-		newConn := NewFrontendConnection(c, nd, myConnStatusNotifier)
-		go newConn.mainLoop(Config.StartupParameters, Config.Databases)
+		configLock.RLock()
+		startupParameters := Config.StartupParameters
+		if serverParams != nil {
+			startupParameters = serverParams.StartupParameters(Config.StartupParameters)
+		}
+		delivery := Config.Delivery
+		databases := Config.Databases
+		configLock.RUnlock()
+
+		newConn := NewFrontendConnection(c, nd, patterns, replay, durableLog, myConnStatusNotifier, delivery, admin)
+		go newConn.mainLoop(startupParameters, databases)
 	}
 }
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"github.com/lib/pq"
+
+	"testing"
+	"time"
+)
+
+func TestListenerWrapperOrder(t *testing.T) {
+	initTestMetrics(t)
+
+	release := make(chan struct{})
+	fetcher := newPayloadFetcherWithLookup([]PayloadFetchConfig{{
+		Channels:        newGlobPattern("fetched"),
+		ReferencePrefix: "ref:",
+		Timeout:         time.Second,
+	}}, func(cfg *PayloadFetchConfig, reference string) (string, error) {
+		if reference == "slow" {
+			<-release
+		}
+		return "payload " + reference, nil
+	})
+	w := &pqListenerWrapper{
+		ch:        make(chan *pq.Notification, 4),
+		patterns:  newPatternSubscriptions(),
+		coalescer: newCoalescer(nil),
+		fetcher:   fetcher,
+		replay:    newReplayBuffers(nil),
+		ready:     make(chan *inflightNotification, 64),
+	}
+	input := make(chan *pq.Notification, 4)
+	go w.workerGoroutine(input)
+	go w.deliveryGoroutine()
+
+	input <- &pq.Notification{Channel: "fetched", Extra: "ref:slow"}
+	input <- &pq.Notification{Channel: "plain", Extra: "plain"}
+	input <- &pq.Notification{Channel: "fetched", Extra: "ref:fast"}
+	input <- nil
+
+	// nothing may overtake the notification waiting for its payload
+	select {
+	case n := <-w.ch:
+		t.Fatalf("got %+v before the slow lookup finished", n)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+
+	for _, expected := range []string{"payload slow", "plain", "payload fast"} {
+		n := <-w.ch
+		if n == nil || n.Extra != expected {
+			t.Fatalf("got %+v; expected payload %q", n, expected)
+		}
+	}
+	if n := <-w.ch; n != nil {
+		t.Fatalf("got %+v; expected the lost connection marker", n)
+	}
+}
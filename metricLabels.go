@@ -0,0 +1,74 @@
+package main
+
+import (
+	"sync"
+)
+
+// The label value used for channels which don't get a label of their own.
+const otherChannelLabel = "other"
+
+// MetricsConfig controls which channels get a label value of their own in the
+// per-channel metrics.
+type MetricsConfig struct {
+	// if false, all channels are folded into "other"
+	Enabled bool
+	// nil means any channel
+	Channels []*channelPattern
+	// maximum number of distinct channel label values, not counting "other"
+	MaxChannels int
+}
+
+// channelLabeler maps channel names to the values of the channel label of the
+// per-channel metrics.  Every label value creates a new time series in every
+// per-channel metric, so only channels matching the configured patterns get
+// their own label value, and only until MaxChannels of them have been seen;
+// the rest are folded into "other".  Since labelled channels are never
+// forgotten, a channel never moves between its own label value and "other".
+type channelLabeler struct {
+	cfg MetricsConfig
+
+	lock     sync.Mutex
+	labelled map[string]struct{}
+}
+
+// The labeler used by all per-channel metrics.  If nil, all channels are
+// labelled "other".
+var channelLabels *channelLabeler
+
+func newChannelLabeler(cfg MetricsConfig) *channelLabeler {
+	return &channelLabeler{
+		cfg:      cfg,
+		labelled: make(map[string]struct{}),
+	}
+}
+
+func (l *channelLabeler) Label(channel string) string {
+	if l == nil || channel == otherChannelLabel {
+		return otherChannelLabel
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	_, ok := l.labelled[channel]
+	if ok {
+		return channel
+	}
+	if len(l.labelled) >= l.cfg.MaxChannels || !l.matches(channel) {
+		return otherChannelLabel
+	}
+	l.labelled[channel] = struct{}{}
+	return channel
+}
+
+func (l *channelLabeler) matches(channel string) bool {
+	if l.cfg.Channels == nil {
+		return true
+	}
+	for _, p := range l.cfg.Channels {
+		if p.Match(channel) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestChannelLabeler(t *testing.T) {
+	l := newChannelLabeler(MetricsConfig{
+		Enabled:     true,
+		Channels:    []*channelPattern{newGlobPattern("orders_*"), newGlobPattern("audit")},
+		MaxChannels: 2,
+	})
+	var tests = []struct {
+		channel string
+		label   string
+	}{
+		{"invoices", "other"},
+		{"orders_1", "orders_1"},
+		{"audit", "audit"},
+		{"orders_2", "other"},
+		{"orders_1", "orders_1"},
+		{"other", "other"},
+	}
+	for _, ts := range tests {
+		if label := l.Label(ts.channel); label != ts.label {
+			t.Errorf("Label(%q) = %q; expected %q", ts.channel, label, ts.label)
+		}
+	}
+
+	var disabled *channelLabeler
+	if label := disabled.Label("orders_1"); label != "other" {
+		t.Errorf("Label on a nil labeler returned %q", label)
+	}
+}
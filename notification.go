@@ -0,0 +1,96 @@
+package main
+
+import (
+	"github.com/lib/pq"
+	"go.opentelemetry.io/otel/trace"
+
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+	"weak"
+)
+
+// notification is the representation of a notification received from the
+// server inside allas.  NotifyDispatcher only knows about *pq.Notification,
+// so that's what we pass around; PqNotification remembers the metadata of the
+// notification in a side table, and notificationFromPq looks it up.
+type notification struct {
+	pq.Notification
+	notificationMetadata
+}
+
+type notificationMetadata struct {
+	// position in the channel's replay buffer, or zero if the channel
+	// doesn't have one
+	seq uint64
+	// offset in the durable log, or zero if it's not enabled
+	offset uint64
+	// when allas received the notification from the server
+	received time.Time
+	// when the producer sent the notification according to its payload, or
+	// the zero time if unknown; see parseProducerTimestamp
+	produced time.Time
+	// true if the notification is being delivered from a replay buffer or
+	// the durable log instead of as it arrived; such notifications are not
+	// included in the latency metrics
+	replayed bool
+	// the span covering the processing of the notification before it's
+	// handed to the dispatcher; the deliveries to clients are its children
+	span trace.SpanContext
+}
+
+// The metadata of the *pq.Notifications returned by PqNotification.  The keys
+// are weak so that an entry doesn't keep its notification alive; the entry is
+// removed once the notification has been garbage collected.
+var notificationMetadataTable sync.Map // weak.Pointer[pq.Notification] -> notificationMetadata
+
+func newNotification(n *pq.Notification) *notification {
+	return &notification{
+		Notification:         *n,
+		notificationMetadata: notificationMetadata{received: time.Now()},
+	}
+}
+
+// Returns a copy of the notification pn was created from by PqNotification.
+// If pn didn't come from PqNotification, the metadata is left zero.
+func notificationFromPq(pn *pq.Notification) *notification {
+	n := &notification{Notification: *pn}
+	if metadata, ok := notificationMetadataTable.Load(weak.Make(pn)); ok {
+		n.notificationMetadata = metadata.(notificationMetadata)
+	}
+	return n
+}
+
+// Returns a new *pq.Notification carrying a copy of n, from which
+// notificationFromPq can recover n.  Later changes to n are not reflected in
+// it.
+func (n *notification) PqNotification() *pq.Notification {
+	pn := new(pq.Notification)
+	*pn = n.Notification
+	key := weak.Make(pn)
+	notificationMetadataTable.Store(key, n.notificationMetadata)
+	runtime.AddCleanup(pn, func(key weak.Pointer[pq.Notification]) {
+		notificationMetadataTable.Delete(key)
+	}, key)
+	return pn
+}
+
+// Parses the time the producer sent a notification from field of its JSON
+// payload.  The value can be either an RFC 3339 timestamp or the number of
+// seconds since the epoch.
+func parseProducerTimestamp(payload, field string) (t time.Time, ok bool) {
+	value, ok := jsonField(payload, field)
+	if !ok {
+		return time.Time{}, false
+	}
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err == nil {
+		return time.Unix(0, int64(seconds*1e9)), true
+	}
+	t, err = time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
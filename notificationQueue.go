@@ -0,0 +1,570 @@
+package main
+
+import (
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"fmt"
+	"sync"
+	"time"
+)
+
+// SlowClientPolicy determines what happens when a client's notification queue
+// is full.
+type SlowClientPolicy int
+
+const (
+	// The client is terminated with SQLSTATE 57A03.
+	SlowClientTerminate SlowClientPolicy = iota
+	// The oldest notification in the queue is discarded to make room.
+	SlowClientDropOldest
+	// The new notification is discarded.
+	SlowClientDropNewest
+	// Hold on to the new notifications until the client makes room in the
+	// queue, and terminate it if it doesn't do so within the configured
+	// timeout, or if more than blockBacklog notifications pile up.
+	SlowClientBlock
+)
+
+// The maximum number of notifications held in addition to the queue depth
+// while SlowClientBlock waits for the client.
+const blockBacklog = 256
+
+// Returns the size of the Go channel the dispatcher sends the notifications of
+// a client with a queue of depth to.  The dispatcher silently discards
+// notifications which don't fit, which would bypass the slow client policy
+// and the dropped notifications metric.  pump never blocks, so the channel is
+// made as large as the queue itself can grow; pump would have to fall behind
+// by that much for the dispatcher to drop anything.
+func notifyChannelSize(depth int) int {
+	return depth + blockBacklog
+}
+
+// The number of notifications read from a replaySource at a time.
+const replayReadSize = 256
+
+func ParseSlowClientPolicy(s string) (SlowClientPolicy, error) {
+	switch s {
+	case "terminate":
+		return SlowClientTerminate, nil
+	case "drop_oldest":
+		return SlowClientDropOldest, nil
+	case "drop_newest":
+		return SlowClientDropNewest, nil
+	case "block":
+		return SlowClientBlock, nil
+	default:
+		return 0, fmt.Errorf("unrecognized slow client policy %q", s)
+	}
+}
+
+func (p SlowClientPolicy) String() string {
+	switch p {
+	case SlowClientTerminate:
+		return "terminate"
+	case SlowClientDropOldest:
+		return "drop_oldest"
+	case SlowClientDropNewest:
+		return "drop_newest"
+	case SlowClientBlock:
+		return "block"
+	default:
+		panic("unknown slow client policy")
+	}
+}
+
+// notificationQueue sits between the NotifyDispatcher and a client's
+// mainLoop.  pump moves notifications from the channel the dispatcher sends
+// to into the queue as quickly as possible, and applies the slow client
+// policy if the queue is full; it never waits for the client, since the
+// dispatcher would discard the notifications it can't send to us.  mainLoop
+// waits on ready and then takes notifications out of the queue using pop.
+//
+// Notifications being replayed are kept apart from the ones which arrived
+// from the dispatcher.  They're read from their source a few at a time as the
+// client consumes them, are delivered first, and don't count towards depth, so
+// replaying a long backlog doesn't trip the slow client policy.
+type notificationQueue struct {
+	policy  SlowClientPolicy
+	timeout time.Duration
+	depth   int
+
+	droppedCounter prometheus.Counter
+
+	// signalled when there's something for mainLoop to do
+	ready chan struct{}
+
+	lock       sync.Mutex
+	items      []*pq.Notification
+	dropped    int
+	terminated bool
+	// running while SlowClientBlock is waiting for the client to make room
+	blockTimer *time.Timer
+
+	// channels subscribed to using LISTEN .. FROM or LISTEN .. CONSUMER, and
+	// the position of the last notification replayed on each
+	replayChannels map[string]replayPosition
+	// the replays which haven't been delivered completely yet, oldest first
+	replays []*replayStream
+
+	// payload filters of channels subscribed to using LISTEN .. WHERE
+	filters map[string]*payloadFilter
+	// if not nil, only notifications on channels for which this returns true
+	// are queued; set before pump is started
+	channelAllowed func(channel string) bool
+
+	channelRateLimits []ChannelRateLimitConfig
+	channelBuckets    map[string]*rateLimitedBucket
+	clientBucket      *rateLimitedBucket
+	// number of notifications collapsed on each channel since the last
+	// "rate limited" notification was queued, and the timers which queue the
+	// next one
+	collapsed      map[string]int
+	collapseTimers map[string]*time.Timer
+}
+
+type rateLimitedBucket struct {
+	bucket *tokenBucket
+	action RateLimitAction
+}
+
+// replayPosition is either a sequence number in a replay buffer, or an offset
+// in the durable log.
+type replayPosition struct {
+	last    uint64
+	offsets bool
+}
+
+func (p replayPosition) of(n *pq.Notification) uint64 {
+	if p.offsets {
+		return notificationFromPq(n).offset
+	}
+	return notificationFromPq(n).seq
+}
+
+// replaySource returns the next notifications to replay, at most max of them.
+// more is false once there are no notifications left.
+type replaySource func(max int) (notifications []*pq.Notification, more bool, err error)
+
+// Returns a replaySource which replays notifications.
+func sliceReplaySource(notifications []*pq.Notification) replaySource {
+	return func(max int) ([]*pq.Notification, bool, error) {
+		count := min(max, len(notifications))
+		batch := notifications[:count]
+		notifications = notifications[count:]
+		return batch, len(notifications) > 0, nil
+	}
+}
+
+// replayStream is a replay in progress.
+type replayStream struct {
+	channel string
+	source  replaySource
+	// read from source, but not popped yet
+	buffered []*pq.Notification
+	more     bool
+}
+
+func newNotificationQueue(policy SlowClientPolicy, timeout time.Duration, depth int, droppedCounter prometheus.Counter) *notificationQueue {
+	return &notificationQueue{
+		policy:  policy,
+		timeout: timeout,
+		depth:   depth,
+
+		droppedCounter: droppedCounter,
+
+		ready: make(chan struct{}, 1),
+
+		items: make([]*pq.Notification, 0, depth),
+
+		replayChannels: make(map[string]replayPosition),
+
+		filters: make(map[string]*payloadFilter),
+
+		channelBuckets: make(map[string]*rateLimitedBucket),
+		collapsed:      make(map[string]int),
+		collapseTimers: make(map[string]*time.Timer),
+	}
+}
+
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// Moves notifications from input into the queue until done is closed or the
+// client has been terminated by the slow client policy.  Runs in its own
+// goroutine.
+func (q *notificationQueue) pump(input <-chan *pq.Notification, done <-chan struct{}) {
+	defer q.stopTimers()
+	for {
+		select {
+		case n := <-input:
+			if !q.push(n) {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// Adds n to the queue, applying the slow client policy if necessary.  Returns
+// false if the client should be terminated.
+func (q *notificationQueue) push(n *pq.Notification) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.terminated {
+		return false
+	}
+	if pos, ok := q.replayChannels[n.Channel]; ok && pos.of(n) <= pos.last {
+		// already delivered by Replay
+		return true
+	}
+	if q.channelAllowed != nil && !q.channelAllowed(n.Channel) {
+		return true
+	}
+	if !q.matchesFilter(n) {
+		MetricNotificationsFiltered.Inc()
+		return true
+	}
+	if !q.allowRate(n.Channel) {
+		return true
+	}
+	return q.enqueue(n)
+}
+
+// Appends n to the queue, applying the slow client policy if the queue is
+// full.  Returns false if the client should be terminated.  The caller must be
+// holding lock.
+func (q *notificationQueue) enqueue(n *pq.Notification) bool {
+	if len(q.items) >= q.depth {
+		switch q.policy {
+		case SlowClientTerminate:
+			return q.terminate()
+
+		case SlowClientDropOldest:
+			copy(q.items, q.items[1:])
+			q.items = q.items[:len(q.items)-1]
+			q.drop()
+
+		case SlowClientDropNewest:
+			q.drop()
+			return true
+
+		case SlowClientBlock:
+			if len(q.items) >= q.depth+blockBacklog {
+				return q.terminate()
+			}
+			if q.blockTimer == nil {
+				var timer *time.Timer
+				timer = time.AfterFunc(q.timeout, func() {
+					q.lock.Lock()
+					defer q.lock.Unlock()
+					if q.blockTimer == timer {
+						q.terminate()
+					}
+				})
+				q.blockTimer = timer
+			}
+		}
+	}
+
+	q.items = append(q.items, n)
+	signal(q.ready)
+	return true
+}
+
+// Replays the notifications from source before any of the ones which arrive
+// from the dispatcher.  From now on, notifications on channel are delivered
+// with their position in place of the process ID, and any notifications with
+// a position not greater than pos.last are skipped as duplicates.
+func (q *notificationQueue) Replay(channel string, source replaySource, pos replayPosition) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.replayChannels[channel] = pos
+	q.removeReplays(channel)
+	q.replays = append(q.replays, &replayStream{
+		channel: channel,
+		source:  source,
+		more:    true,
+	})
+
+	items := q.items[:0]
+	for _, n := range q.items {
+		if n.Channel != channel || pos.of(n) > pos.last {
+			items = append(items, n)
+		}
+	}
+	for i := len(items); i < len(q.items); i++ {
+		q.items[i] = nil
+	}
+	q.items = items
+	signal(q.ready)
+}
+
+// Reverts the effects of Replay on channel.
+func (q *notificationQueue) StopReplay(channel string) {
+	q.lock.Lock()
+	delete(q.replayChannels, channel)
+	q.removeReplays(channel)
+	q.lock.Unlock()
+}
+
+// The caller must be holding lock.
+func (q *notificationQueue) removeReplays(channel string) {
+	replays := q.replays[:0]
+	for _, r := range q.replays {
+		if r.channel != channel {
+			replays = append(replays, r)
+		}
+	}
+	for i := len(replays); i < len(q.replays); i++ {
+		q.replays[i] = nil
+	}
+	q.replays = replays
+}
+
+// Reads more notifications from the source of the oldest replay if everything
+// read from it so far has been popped.  The source is read without holding
+// lock; only pop calls this, so nobody else reads from it at the same time.
+func (q *notificationQueue) readReplay() {
+	q.lock.Lock()
+	var r *replayStream
+	if len(q.replays) > 0 && len(q.replays[0].buffered) == 0 && q.replays[0].more {
+		r = q.replays[0]
+	}
+	q.lock.Unlock()
+	if r == nil {
+		return
+	}
+
+	notifications, more, err := r.source(replayReadSize)
+	if err != nil {
+		elog.Warningf("could not replay notifications on channel %q: %s", r.channel, err)
+		notifications, more = nil, false
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	r.more = more
+	for _, n := range notifications {
+		if q.matchesFilter(n) {
+			replayed := notificationFromPq(n)
+			replayed.replayed = true
+			r.buffered = append(r.buffered, replayed.PqNotification())
+		}
+	}
+}
+
+// Only notifications on channel matching filter will be added to the queue
+// from now on.  A nil filter lets all of them through.  Returns the filter
+// previously set on channel.
+func (q *notificationQueue) SetFilter(channel string, filter *payloadFilter) (previous *payloadFilter) {
+	q.lock.Lock()
+	previous = q.filters[channel]
+	if filter == nil {
+		delete(q.filters, channel)
+	} else {
+		q.filters[channel] = filter
+	}
+	q.lock.Unlock()
+	return previous
+}
+
+// The caller must be holding lock.
+func (q *notificationQueue) matchesFilter(n *pq.Notification) bool {
+	filter, ok := q.filters[n.Channel]
+	return !ok || filter.Match(n.Extra)
+}
+
+// Sets the rate limits of the client.  channelLimits apply to each channel
+// separately, using the first entry matching the channel; clientLimit, if not
+// nil, applies to all notifications.
+func (q *notificationQueue) SetRateLimits(channelLimits []ChannelRateLimitConfig, clientLimit *RateLimitConfig) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.channelRateLimits = channelLimits
+	q.channelBuckets = make(map[string]*rateLimitedBucket)
+	q.clientBucket = nil
+	if clientLimit != nil {
+		q.clientBucket = &rateLimitedBucket{newTokenBucket(*clientLimit), clientLimit.Action}
+	}
+}
+
+// Returns the bucket limiting the rate of notifications on channel, or nil.
+// The caller must be holding lock.
+func (q *notificationQueue) channelBucket(channel string) *rateLimitedBucket {
+	b, ok := q.channelBuckets[channel]
+	if ok {
+		return b
+	}
+	for _, cfg := range q.channelRateLimits {
+		if cfg.Channels.Match(channel) {
+			b = &rateLimitedBucket{newTokenBucket(cfg.RateLimitConfig), cfg.Action}
+			break
+		}
+	}
+	q.channelBuckets[channel] = b
+	return b
+}
+
+// Returns false if a notification on channel exceeds a rate limit and should
+// not be delivered.  A token is only taken out of the buckets if the
+// notification is within all of the limits.  The caller must be holding lock.
+func (q *notificationQueue) allowRate(channel string) bool {
+	now := time.Now()
+	buckets := []*rateLimitedBucket{q.channelBucket(channel), q.clientBucket}
+	for _, b := range buckets {
+		if b != nil && !b.bucket.Available(now) {
+			q.rateLimited(channel, b, now)
+			return false
+		}
+	}
+	for _, b := range buckets {
+		if b != nil {
+			b.bucket.Take()
+		}
+	}
+	return true
+}
+
+// The caller must be holding lock.
+func (q *notificationQueue) rateLimited(channel string, b *rateLimitedBucket, now time.Time) {
+	MetricNotificationsRateLimited.Inc()
+	if b.action != RateLimitCollapse {
+		return
+	}
+	q.collapsed[channel]++
+	if q.collapsed[channel] == 1 {
+		var timer *time.Timer
+		timer = time.AfterFunc(b.bucket.Delay(now), func() {
+			q.lock.Lock()
+			defer q.lock.Unlock()
+			if !q.terminated && q.collapseTimers[channel] == timer {
+				q.flushCollapsed(channel)
+			}
+		})
+		q.collapseTimers[channel] = timer
+	}
+}
+
+// Queues a single notification in place of the ones collapsed on channel,
+// subject to the slow client policy like any other notification.  The caller
+// must be holding lock.
+func (q *notificationQueue) flushCollapsed(channel string) {
+	count := q.collapsed[channel]
+	delete(q.collapsed, channel)
+	delete(q.collapseTimers, channel)
+	n := newNotification(&pq.Notification{
+		Channel: channel,
+		Extra:   fmt.Sprintf("rate limited, %d dropped", count),
+	})
+	q.enqueue(n.PqNotification())
+}
+
+// Stops the timers started by the queue.  Called once the client has gone
+// away.
+func (q *notificationQueue) stopTimers() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.blockTimer != nil {
+		q.blockTimer.Stop()
+		q.blockTimer = nil
+	}
+	for channel, timer := range q.collapseTimers {
+		timer.Stop()
+		delete(q.collapseTimers, channel)
+		delete(q.collapsed, channel)
+	}
+}
+
+// The caller must be holding lock.
+func (q *notificationQueue) drop() {
+	q.dropped++
+	q.droppedCounter.Inc()
+	signal(q.ready)
+}
+
+// The caller must be holding lock.
+func (q *notificationQueue) terminate() bool {
+	q.terminated = true
+	signal(q.ready)
+	return false
+}
+
+// Returns the number of notifications waiting in the queue, including the
+// ones read for replay.
+func (q *notificationQueue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	count := len(q.items)
+	for _, r := range q.replays {
+		count += len(r.buffered)
+	}
+	return count
+}
+
+// Removes at most max notifications from the queue, replayed ones first.
+// dropped is the number of notifications which have been dropped since the
+// last call to pop.  If ok is false, the client should be terminated.
+func (q *notificationQueue) pop(max int) (batch []*pq.Notification, dropped int, ok bool) {
+	q.readReplay()
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.terminated {
+		return nil, 0, false
+	}
+
+	batch = make([]*pq.Notification, 0, max)
+	for len(q.replays) > 0 && len(batch) < max {
+		r := q.replays[0]
+		count := min(max-len(batch), len(r.buffered))
+		batch = append(batch, r.buffered[:count]...)
+		r.buffered = r.buffered[count:]
+		if len(r.buffered) > 0 || r.more {
+			// the rest of the replay must be delivered before anything else
+			break
+		}
+		q.replays[0] = nil
+		q.replays = q.replays[1:]
+	}
+	live := 0
+	if len(q.replays) == 0 {
+		live = min(max-len(batch), len(q.items))
+		batch = append(batch, q.items[:live]...)
+	}
+	if len(q.replayChannels) > 0 {
+		for i, n := range batch {
+			if pos, ok := q.replayChannels[n.Channel]; ok {
+				withPos := notificationFromPq(n)
+				withPos.BePid = int(pos.of(n) & (1<<31 - 1))
+				batch[i] = withPos.PqNotification()
+			}
+		}
+	}
+	remaining := copy(q.items, q.items[live:])
+	for i := remaining; i < len(q.items); i++ {
+		q.items[i] = nil
+	}
+	q.items = q.items[:remaining]
+
+	if remaining > 0 || len(q.replays) > 0 {
+		signal(q.ready)
+	}
+	if q.blockTimer != nil && remaining <= q.depth {
+		q.blockTimer.Stop()
+		q.blockTimer = nil
+	}
+
+	dropped = q.dropped
+	q.dropped = 0
+	return batch, dropped, true
+}
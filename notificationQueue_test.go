@@ -0,0 +1,232 @@
+package main
+
+import (
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"testing"
+	"time"
+)
+
+func TestNotificationQueuePolicies(t *testing.T) {
+	notification := func(payload string) *pq.Notification {
+		return newNotification(&pq.Notification{Channel: "foo", Extra: payload}).PqNotification()
+	}
+
+	var tests = []struct {
+		policy   SlowClientPolicy
+		pushOk   bool
+		popOk    bool
+		payloads []string
+		dropped  int
+	}{
+		{SlowClientTerminate, false, false, nil, 0},
+		{SlowClientDropOldest, true, true, []string{"2", "3"}, 1},
+		{SlowClientDropNewest, true, true, []string{"1", "2"}, 1},
+		{SlowClientBlock, true, true, []string{"1", "2", "3"}, 0},
+	}
+
+	for _, ts := range tests {
+		counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "dropped"})
+		q := newNotificationQueue(ts.policy, 10*time.Millisecond, 2, counter)
+
+		for _, payload := range []string{"1", "2"} {
+			if !q.push(notification(payload)) {
+				t.Fatalf("%s: push failed on a queue which isn't full", ts.policy)
+			}
+		}
+		if q.push(notification("3")) != ts.pushOk {
+			t.Errorf("%s: unexpected push result", ts.policy)
+		}
+
+		batch, dropped, ok := q.pop(10)
+		if ok != ts.popOk {
+			t.Errorf("%s: pop returned ok %v; expected %v", ts.policy, ok, ts.popOk)
+		}
+		if dropped != ts.dropped {
+			t.Errorf("%s: %d notifications dropped; expected %d", ts.policy, dropped, ts.dropped)
+		}
+		if len(batch) != len(ts.payloads) {
+			t.Errorf("%s: got %d notifications; expected %d", ts.policy, len(batch), len(ts.payloads))
+			continue
+		}
+		for i, n := range batch {
+			if n.Extra != ts.payloads[i] {
+				t.Errorf("%s: notification %d has payload %q; expected %q", ts.policy, i, n.Extra, ts.payloads[i])
+			}
+		}
+		q.stopTimers()
+	}
+}
+
+func TestNotificationQueueBlock(t *testing.T) {
+	notification := func(payload string) *pq.Notification {
+		return newNotification(&pq.Notification{Extra: payload}).PqNotification()
+	}
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "dropped"})
+
+	// the client makes room in time
+	q := newNotificationQueue(SlowClientBlock, 50*time.Millisecond, 1, counter)
+	q.push(notification("1"))
+	if !q.push(notification("2")) {
+		t.Fatalf("push did not wait for room in the queue")
+	}
+	batch, _, ok := q.pop(1)
+	if !ok || len(batch) != 1 || batch[0].Extra != "1" {
+		t.Fatalf("unexpected queue contents %+v", batch)
+	}
+	time.Sleep(100 * time.Millisecond)
+	batch, _, ok = q.pop(1)
+	if !ok || len(batch) != 1 || batch[0].Extra != "2" {
+		t.Fatalf("unexpected queue contents %+v", batch)
+	}
+
+	// the client doesn't make room within the timeout
+	q = newNotificationQueue(SlowClientBlock, 10*time.Millisecond, 1, counter)
+	q.push(notification("1"))
+	q.push(notification("2"))
+	time.Sleep(50 * time.Millisecond)
+	if _, _, ok := q.pop(1); ok {
+		t.Fatalf("client was not terminated after the timeout")
+	}
+	if q.push(notification("3")) {
+		t.Fatalf("push succeeded after the client was terminated")
+	}
+
+	// too many notifications pile up
+	q = newNotificationQueue(SlowClientBlock, time.Minute, 1, counter)
+	defer q.stopTimers()
+	for i := 0; i < 1+blockBacklog; i++ {
+		if !q.push(notification("x")) {
+			t.Fatalf("push %d failed", i)
+		}
+	}
+	if q.push(notification("x")) {
+		t.Fatalf("push succeeded with the backlog full")
+	}
+}
+
+func TestNotificationQueueRateLimit(t *testing.T) {
+	initTestMetrics(t)
+
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "dropped"})
+	q := newNotificationQueue(SlowClientTerminate, time.Second, 100, counter)
+	q.SetRateLimits([]ChannelRateLimitConfig{
+		{newGlobPattern("busy_*"), RateLimitConfig{Rate: 20, Burst: 2, Action: RateLimitCollapse}},
+	}, &RateLimitConfig{Rate: 1000, Burst: 5, Action: RateLimitDrop})
+
+	for _, channel := range []string{"busy_1", "busy_1", "busy_1", "busy_1", "quiet", "quiet", "quiet", "quiet"} {
+		q.push(newNotification(&pq.Notification{Channel: channel}).PqNotification())
+	}
+	<-q.ready
+	batch, _, _ := q.pop(100)
+	var channels []string
+	for _, n := range batch {
+		channels = append(channels, n.Channel)
+	}
+	// two on busy_1 because of its burst, and three on quiet because of the
+	// client's burst
+	if len(channels) != 5 || channels[1] != "busy_1" || channels[2] != "quiet" {
+		t.Fatalf("unexpected notifications %v", channels)
+	}
+
+	select {
+	case <-q.ready:
+	case <-time.After(time.Second):
+		t.Fatalf("collapsed notifications were not reported")
+	}
+	batch, _, _ = q.pop(100)
+	if len(batch) != 1 || batch[0].Channel != "busy_1" || batch[0].Extra != "rate limited, 2 dropped" {
+		t.Fatalf("unexpected notifications %+v", batch)
+	}
+}
+
+func TestNotificationQueueRateLimitBuckets(t *testing.T) {
+	initTestMetrics(t)
+
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "dropped"})
+	notification := func(channel string) *pq.Notification {
+		return newNotification(&pq.Notification{Channel: channel}).PqNotification()
+	}
+
+	// a notification rejected by the client's limit must not use up a token
+	// of the channel's
+	q := newNotificationQueue(SlowClientTerminate, time.Second, 100, counter)
+	q.SetRateLimits([]ChannelRateLimitConfig{
+		{newGlobPattern("busy_*"), RateLimitConfig{Rate: 0.001, Burst: 1, Action: RateLimitDrop}},
+	}, &RateLimitConfig{Rate: 0.001, Burst: 1, Action: RateLimitDrop})
+	q.push(notification("quiet"))
+	q.push(notification("busy_1"))
+	if !q.channelBuckets["busy_1"].bucket.Available(time.Now()) {
+		t.Fatalf("the channel's token was taken by a notification which was not delivered")
+	}
+
+	// the collapsed notification is subject to the slow client policy
+	q = newNotificationQueue(SlowClientTerminate, time.Second, 1, counter)
+	q.SetRateLimits([]ChannelRateLimitConfig{
+		{newGlobPattern("busy_*"), RateLimitConfig{Rate: 20, Burst: 1, Action: RateLimitCollapse}},
+	}, nil)
+	q.push(notification("busy_1"))
+	q.push(notification("busy_1"))
+	time.Sleep(100 * time.Millisecond)
+	if _, _, ok := q.pop(1); ok {
+		t.Fatalf("collapsed notification overflowed the queue without terminating the client")
+	}
+
+	// .. and it's not queued at all once the client has gone away
+	q = newNotificationQueue(SlowClientTerminate, time.Second, 10, counter)
+	q.SetRateLimits([]ChannelRateLimitConfig{
+		{newGlobPattern("busy_*"), RateLimitConfig{Rate: 20, Burst: 1, Action: RateLimitCollapse}},
+	}, nil)
+	q.push(notification("busy_1"))
+	q.push(notification("busy_1"))
+	q.stopTimers()
+	time.Sleep(100 * time.Millisecond)
+	if q.Len() != 1 {
+		t.Fatalf("collapsed notification was queued after the timers were stopped")
+	}
+}
+
+func TestNotificationQueueReplayBacklog(t *testing.T) {
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "dropped"})
+	notification := func(seq uint64) *pq.Notification {
+		n := newNotification(&pq.Notification{Channel: "foo"})
+		n.seq = seq
+		return n.PqNotification()
+	}
+
+	// a replay much longer than the queue is deep must not trip the slow
+	// client policy
+	const depth = 4
+	var replay []*pq.Notification
+	for seq := uint64(1); seq <= 3*replayReadSize; seq++ {
+		replay = append(replay, notification(seq))
+	}
+	q := newNotificationQueue(SlowClientTerminate, time.Second, depth, counter)
+	q.Replay("foo", sliceReplaySource(replay), replayPosition{uint64(len(replay)), false})
+	for seq := uint64(len(replay)) + 1; seq <= uint64(len(replay))+depth; seq++ {
+		if !q.push(notification(seq)) {
+			t.Fatalf("live notification %d terminated the client", seq)
+		}
+	}
+
+	expected := 1
+	for expected <= len(replay)+depth {
+		batch, _, ok := q.pop(100)
+		if !ok {
+			t.Fatalf("client was terminated")
+		}
+		if len(batch) == 0 {
+			t.Fatalf("queue ran dry after %d notifications", expected-1)
+		}
+		for _, n := range batch {
+			if n.BePid != expected {
+				t.Fatalf("got notification %d; expected %d", n.BePid, expected)
+			}
+			expected++
+		}
+	}
+	if q.Len() != 0 {
+		t.Fatalf("%d notifications left in the queue", q.Len())
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"github.com/lib/pq"
+
+	"runtime"
+	"testing"
+	"time"
+	"weak"
+)
+
+func TestParseProducerTimestamp(t *testing.T) {
+	var tests = []struct {
+		payload  string
+		expected time.Time
+		ok       bool
+	}{
+		{`{"sent_at": "2024-05-01T12:00:00.5Z"}`, time.Date(2024, 5, 1, 12, 0, 0, 5e8, time.UTC), true},
+		{`{"sent_at": 1714564800.5}`, time.Date(2024, 5, 1, 12, 0, 0, 5e8, time.UTC), true},
+		{`{"sent_at": "yesterday"}`, time.Time{}, false},
+		{`{"other": 1}`, time.Time{}, false},
+		{`sent_at`, time.Time{}, false},
+	}
+	for _, ts := range tests {
+		got, ok := parseProducerTimestamp(ts.payload, "sent_at")
+		if ok != ts.ok || !got.Equal(ts.expected) {
+			t.Errorf("parseProducerTimestamp(%q) = %v, %v; expected %v, %v", ts.payload, got, ok, ts.expected, ts.ok)
+		}
+	}
+}
+
+func TestNotificationMetadata(t *testing.T) {
+	n := newNotification(&pq.Notification{Channel: "foo", Extra: "bar"})
+	n.seq = 7
+	pn := n.PqNotification()
+	n.seq = 8
+
+	recovered := notificationFromPq(pn)
+	if recovered.Channel != "foo" || recovered.Extra != "bar" || recovered.seq != 7 || !recovered.received.Equal(n.received) {
+		t.Fatalf("unexpected notification %+v", recovered)
+	}
+
+	// not created by PqNotification
+	foreign := notificationFromPq(&pq.Notification{Channel: "foo"})
+	if foreign.Channel != "foo" || foreign.seq != 0 || !foreign.received.IsZero() {
+		t.Fatalf("unexpected notification %+v", foreign)
+	}
+
+	key := weak.Make(pn)
+	pn = nil
+	for i := 0; i < 100; i++ {
+		runtime.GC()
+		if _, ok := notificationMetadataTable.Load(key); !ok {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("metadata was not removed after the notification was collected")
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"github.com/lib/pq"
+
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+)
+
+// The ParameterStatus values we copy from the upstream server when
+// forward_server_parameters is enabled.  Parameters which can be changed for a
+// particular session (e.g. client_encoding, TimeZone or
+// standard_conforming_strings) are deliberately not included, since we'd be
+// forwarding the settings of our own session.
+var forwardedServerParameters = []string{
+	"server_version",
+	"server_encoding",
+	"integer_datetimes",
+}
+
+// serverParameters keeps track of the ParameterStatus values most recently
+// reported by the upstream server.  The values are refreshed every time the
+// listener (re-)establishes its connection, before new clients are accepted.
+// If that fails, no values are forwarded until the next refresh.
+type serverParameters struct {
+	db *sql.DB
+
+	lock   sync.Mutex
+	values map[string]string
+}
+
+func newServerParameters(connector *pq.Connector) *serverParameters {
+	db := sql.OpenDB(connector)
+	// We only need a connection while refreshing; don't keep it around.
+	db.SetMaxIdleConns(0)
+
+	return &serverParameters{
+		db:     db,
+		values: make(map[string]string),
+	}
+}
+
+// Fetches the current values of forwardedServerParameters from the server.
+// Parameters the server doesn't know about are silently skipped.
+func (p *serverParameters) Refresh() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	rows, err := p.db.QueryContext(ctx,
+		`SELECT name, current_setting(name, true) FROM unnest($1::text[]) name`,
+		pq.Array(forwardedServerParameters),
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	values := make(map[string]string)
+	for rows.Next() {
+		var name string
+		var value sql.NullString
+		err = rows.Scan(&name, &value)
+		if err != nil {
+			return err
+		}
+		if value.Valid {
+			values[name] = value.String
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	p.lock.Lock()
+	p.values = values
+	p.lock.Unlock()
+	return nil
+}
+
+// Forgets the values fetched by Refresh.
+func (p *serverParameters) Clear() {
+	p.lock.Lock()
+	p.values = make(map[string]string)
+	p.lock.Unlock()
+}
+
+// Returns the set of startup parameters to send to a new client.  The values
+// in overrides take precedence over the ones reported by the server.
+func (p *serverParameters) StartupParameters(overrides map[string]string) map[string]string {
+	p.lock.Lock()
+	params := make(map[string]string, len(p.values)+len(overrides))
+	for k, v := range p.values {
+		params[k] = v
+	}
+	p.lock.Unlock()
+
+	for k, v := range overrides {
+		params[k] = v
+	}
+	return params
+}
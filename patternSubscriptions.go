@@ -0,0 +1,106 @@
+package main
+
+import (
+	"github.com/lib/pq"
+
+	"sync"
+)
+
+// patternSubscriptions delivers notifications to clients which have
+// subscribed to channel patterns using LISTEN PATTERN.  Postgres has no notion
+// of pattern subscriptions, so a pattern only ever matches notifications on
+// channels LISTENed on upstream for some other reason: an exact LISTEN by any
+// client, or the upstream.channels configuration option.
+//
+// To avoid delivering the same notification twice, we also keep track of the
+// exact channels each subscriber is listening on; those notifications are
+// delivered by the NotifyDispatcher.
+type patternSubscriptions struct {
+	lock        sync.RWMutex
+	subscribers map[chan<- *pq.Notification]*patternSubscriber
+}
+
+type patternSubscriber struct {
+	patterns map[string]*channelPattern
+	channels map[string]struct{}
+}
+
+func newPatternSubscriptions() *patternSubscriptions {
+	return &patternSubscriptions{
+		subscribers: make(map[chan<- *pq.Notification]*patternSubscriber),
+	}
+}
+
+// The caller must be holding lock.
+func (s *patternSubscriptions) subscriber(ch chan<- *pq.Notification) *patternSubscriber {
+	sub, ok := s.subscribers[ch]
+	if !ok {
+		sub = &patternSubscriber{
+			patterns: make(map[string]*channelPattern),
+			channels: make(map[string]struct{}),
+		}
+		s.subscribers[ch] = sub
+	}
+	return sub
+}
+
+func (s *patternSubscriptions) Listen(pattern *channelPattern, ch chan<- *pq.Notification) {
+	s.lock.Lock()
+	s.subscriber(ch).patterns[pattern.String()] = pattern
+	s.lock.Unlock()
+}
+
+func (s *patternSubscriptions) Unlisten(pattern string, ch chan<- *pq.Notification) {
+	s.lock.Lock()
+	sub, ok := s.subscribers[ch]
+	if ok {
+		delete(sub.patterns, pattern)
+	}
+	s.lock.Unlock()
+}
+
+// Records that ch is receiving notifications on channel from the dispatcher.
+func (s *patternSubscriptions) AddChannel(channel string, ch chan<- *pq.Notification) {
+	s.lock.Lock()
+	s.subscriber(ch).channels[channel] = struct{}{}
+	s.lock.Unlock()
+}
+
+func (s *patternSubscriptions) RemoveChannel(channel string, ch chan<- *pq.Notification) {
+	s.lock.Lock()
+	sub, ok := s.subscribers[ch]
+	if ok {
+		delete(sub.channels, channel)
+	}
+	s.lock.Unlock()
+}
+
+// Removes all subscriptions of ch.
+func (s *patternSubscriptions) Remove(ch chan<- *pq.Notification) {
+	s.lock.Lock()
+	delete(s.subscribers, ch)
+	s.lock.Unlock()
+}
+
+// Sends n to every subscriber with a matching pattern.  Like the
+// NotifyDispatcher, we never block; if a subscriber's channel is full, the
+// notification is not delivered to it.
+func (s *patternSubscriptions) Dispatch(n *pq.Notification) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for ch, sub := range s.subscribers {
+		if _, ok := sub.channels[n.Channel]; ok {
+			continue
+		}
+		for _, pattern := range sub.patterns {
+			if pattern.Match(n.Channel) {
+				select {
+				case ch <- n:
+				default:
+				}
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"github.com/lib/pq"
+
+	"container/list"
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PayloadFetchConfig specifies how the payloads of notifications on channels
+// matching Channels are fetched from the server.  Notifications whose payload
+// starts with ReferencePrefix carry a reference (the rest of the payload)
+// instead of the actual payload, which is fetched by running Query with the
+// reference as its only parameter.
+type PayloadFetchConfig struct {
+	Channels        *channelPattern
+	ReferencePrefix string
+	Query           string
+	Timeout         time.Duration
+	CacheSize       int
+	// zero means entries don't expire
+	CacheTTL time.Duration
+}
+
+// The number of goroutines running lookup queries.  All notifications on a
+// channel are handled by the same goroutine, so a slow lookup only holds up
+// the channels sharing its goroutine.
+const payloadFetchWorkers = 8
+
+// payloadFetcher resolves the references in notifications carrying large
+// payloads which don't fit into a NOTIFY, so that clients don't need a
+// database connection of their own to do it.  It runs the lookup queries over
+// a connection separate from the one we LISTEN on.
+type payloadFetcher struct {
+	db      *sql.DB
+	configs []PayloadFetchConfig
+	caches  []*payloadCache
+	// runs the lookup query of cfg; replaced in tests
+	lookup func(cfg *PayloadFetchConfig, reference string) (string, error)
+
+	queues []chan fetchRequest
+}
+
+type fetchRequest struct {
+	n    *notification
+	done func(n *notification)
+}
+
+func newPayloadFetcher(connector *pq.Connector, configs []PayloadFetchConfig) *payloadFetcher {
+	db := sql.OpenDB(connector)
+	db.SetMaxIdleConns(1)
+	db.SetMaxOpenConns(payloadFetchWorkers)
+
+	f := newPayloadFetcherWithLookup(configs, nil)
+	f.db = db
+	f.lookup = f.query
+	return f
+}
+
+func newPayloadFetcherWithLookup(configs []PayloadFetchConfig, lookup func(cfg *PayloadFetchConfig, reference string) (string, error)) *payloadFetcher {
+	f := &payloadFetcher{
+		configs: configs,
+		lookup:  lookup,
+	}
+	for _, cfg := range configs {
+		f.caches = append(f.caches, newPayloadCache(cfg.CacheSize, cfg.CacheTTL))
+	}
+	for i := 0; i < payloadFetchWorkers; i++ {
+		queue := make(chan fetchRequest, 256)
+		f.queues = append(f.queues, queue)
+		go f.worker(queue)
+	}
+	return f
+}
+
+// Returns true if notifications on channel might carry a reference, i.e. if
+// they need to go through Submit.
+func (f *payloadFetcher) Matches(channel string) bool {
+	for _, cfg := range f.configs {
+		if cfg.Channels.Match(channel) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolves the reference in n in the background, and calls done with n once
+// that has finished, whether the payload could be fetched or not.  done is
+// called for the notifications on a channel in the order they were submitted
+// in.  Blocks if too many notifications are waiting for their goroutine.
+func (f *payloadFetcher) Submit(n *notification, done func(n *notification)) {
+	h := fnv.New32a()
+	h.Write([]byte(n.Channel))
+	f.queues[h.Sum32()%uint32(len(f.queues))] <- fetchRequest{n, done}
+}
+
+func (f *payloadFetcher) worker(queue <-chan fetchRequest) {
+	for req := range queue {
+		err := f.Fetch(req.n)
+		if err != nil {
+			elog.Warningf("could not fetch the payload of a notification on channel %q: %s", req.n.Channel, err)
+		}
+		req.done(req.n)
+	}
+}
+
+// Replaces the payload of n if it carries a reference.  If the payload can't
+// be fetched, n is left alone and an error is returned.
+func (f *payloadFetcher) Fetch(n *notification) error {
+	for i, cfg := range f.configs {
+		if !cfg.Channels.Match(n.Channel) {
+			continue
+		}
+		if !strings.HasPrefix(n.Extra, cfg.ReferencePrefix) {
+			return nil
+		}
+		reference := strings.TrimPrefix(n.Extra, cfg.ReferencePrefix)
+
+		cache := f.caches[i]
+		payload, ok := cache.Get(reference)
+		if ok {
+			MetricPayloadFetches.WithLabelValues("cache_hit").Inc()
+			n.Extra = payload
+			return nil
+		}
+
+		payload, err := f.lookup(&cfg, reference)
+		if err != nil {
+			MetricPayloadFetches.WithLabelValues("failed").Inc()
+			return err
+		}
+		MetricPayloadFetches.WithLabelValues("fetched").Inc()
+		cache.Put(reference, payload)
+		n.Extra = payload
+		return nil
+	}
+	return nil
+}
+
+func (f *payloadFetcher) query(cfg *PayloadFetchConfig, reference string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+
+	var payload sql.NullString
+	err := f.db.QueryRowContext(ctx, cfg.Query, reference).Scan(&payload)
+	if err == sql.ErrNoRows || (err == nil && !payload.Valid) {
+		return "", fmt.Errorf("no payload found for reference %q", reference)
+	} else if err != nil {
+		return "", err
+	}
+	return payload.String, nil
+}
+
+// payloadCache is a size-limited LRU cache of fetched payloads.
+type payloadCache struct {
+	size int
+	ttl  time.Duration
+
+	lock    sync.Mutex
+	entries map[string]*list.Element
+	// most recently used first
+	lru *list.List
+}
+
+type payloadCacheEntry struct {
+	reference string
+	payload   string
+	fetched   time.Time
+}
+
+func newPayloadCache(size int, ttl time.Duration) *payloadCache {
+	return &payloadCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (c *payloadCache) Get(reference string) (payload string, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	el, ok := c.entries[reference]
+	if !ok {
+		return "", false
+	}
+	entry := el.Value.(*payloadCacheEntry)
+	if c.ttl > 0 && time.Since(entry.fetched) > c.ttl {
+		c.lru.Remove(el)
+		delete(c.entries, reference)
+		return "", false
+	}
+	c.lru.MoveToFront(el)
+	return entry.payload, true
+}
+
+func (c *payloadCache) Put(reference, payload string) {
+	if c.size == 0 {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if el, ok := c.entries[reference]; ok {
+		c.lru.Remove(el)
+	}
+	c.entries[reference] = c.lru.PushFront(&payloadCacheEntry{reference, payload, time.Now()})
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*payloadCacheEntry).reference)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"github.com/lib/pq"
+
+	"fmt"
+	"hash/fnv"
+	"testing"
+	"time"
+)
+
+func TestPayloadCache(t *testing.T) {
+	c := newPayloadCache(2, 0)
+	c.Put("a", "1")
+	c.Put("b", "2")
+	if _, ok := c.Get("a"); !ok {
+		t.Fatalf("entry a missing")
+	}
+	// b is now the least recently used entry
+	c.Put("c", "3")
+	if _, ok := c.Get("b"); ok {
+		t.Errorf("entry b was not evicted")
+	}
+	for reference, expected := range map[string]string{"a": "1", "c": "3"} {
+		payload, ok := c.Get(reference)
+		if !ok || payload != expected {
+			t.Errorf("unexpected payload %q for reference %q", payload, reference)
+		}
+	}
+
+	c = newPayloadCache(2, 10*time.Millisecond)
+	c.Put("a", "1")
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := c.Get("a"); ok {
+		t.Errorf("expired entry returned")
+	}
+}
+
+func fetchWorker(channel string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(channel))
+	return h.Sum32() % payloadFetchWorkers
+}
+
+func TestPayloadFetcherWorkers(t *testing.T) {
+	initTestMetrics(t)
+
+	// find a channel which isn't handled by the same goroutine as "slow"
+	fast := ""
+	for i := 0; fast == ""; i++ {
+		channel := fmt.Sprintf("fast%d", i)
+		if fetchWorker(channel) != fetchWorker("slow") {
+			fast = channel
+		}
+	}
+
+	release := make(chan struct{})
+	f := newPayloadFetcherWithLookup([]PayloadFetchConfig{{
+		Channels:        newGlobPattern("*"),
+		ReferencePrefix: "ref:",
+		Timeout:         time.Second,
+	}}, func(cfg *PayloadFetchConfig, reference string) (string, error) {
+		if reference == "blocked" {
+			<-release
+		}
+		return "payload " + reference, nil
+	})
+
+	done := make(chan *notification, 10)
+	submit := func(channel, payload string) {
+		f.Submit(newNotification(&pq.Notification{Channel: channel, Extra: payload}), func(n *notification) {
+			done <- n
+		})
+	}
+	submit("slow", "ref:blocked")
+	submit("slow", "ref:second")
+	submit(fast, "ref:fast")
+
+	select {
+	case n := <-done:
+		if n.Channel != fast || n.Extra != "payload fast" {
+			t.Fatalf("unexpected notification %+v", n.PqNotification())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("a blocked lookup held up another channel")
+	}
+
+	close(release)
+	for _, expected := range []string{"payload blocked", "payload second"} {
+		n := <-done
+		if n.Extra != expected {
+			t.Fatalf("expected %q, got %q", expected, n.Extra)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+type payloadFilterOperator int
+
+const (
+	filterEquals payloadFilterOperator = iota
+	filterLike
+	filterRegex
+)
+
+var errInvalidFilterOperator = errors.New("invalid filter operator")
+
+func parsePayloadFilterOperator(s string) (payloadFilterOperator, error) {
+	switch s {
+	case "=":
+		return filterEquals, nil
+	case "like":
+		return filterLike, nil
+	case "~":
+		return filterRegex, nil
+	default:
+		return 0, fmt.Errorf("operator does not exist: %s", s)
+	}
+}
+
+// payloadFilter restricts a subscription to the notifications whose payload,
+// or a top-level field of the payload parsed as a JSON object, matches a
+// value.  It's the compiled form of the condition in
+//
+//	LISTEN channel WHERE payload [->> 'key'] { = | LIKE | ~ } 'value'
+type payloadFilter struct {
+	// empty if the whole payload is compared
+	key   string
+	op    payloadFilterOperator
+	value string
+	re    *regexp.Regexp
+}
+
+// Compiles a payload filter.  An invalid LIKE pattern or regular expression
+// is reported as an error.
+func newPayloadFilter(key string, op payloadFilterOperator, value string) (*payloadFilter, error) {
+	f := &payloadFilter{
+		key:   key,
+		op:    op,
+		value: value,
+	}
+	switch op {
+	case filterLike:
+		pattern, err := newLikePattern(value)
+		if err != nil {
+			return nil, err
+		}
+		f.re = pattern.re
+	case filterRegex:
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return nil, err
+		}
+		f.re = re
+	case filterEquals:
+	default:
+		return nil, errInvalidFilterOperator
+	}
+	return f, nil
+}
+
+func (f *payloadFilter) Match(payload string) bool {
+	value := payload
+	if f.key != "" {
+		var ok bool
+		value, ok = jsonField(payload, f.key)
+		if !ok {
+			return false
+		}
+	}
+	if f.op == filterEquals {
+		return value == f.value
+	}
+	return f.re.MatchString(value)
+}
+
+// Returns the value of the top-level field key in the JSON object in payload
+// as text, like the ->> operator in PostgreSQL.  ok is false if the payload is
+// not a JSON object, or the field is missing or null.
+func jsonField(payload string, key string) (value string, ok bool) {
+	var object map[string]json.RawMessage
+	if json.Unmarshal([]byte(payload), &object) != nil {
+		return "", false
+	}
+	raw, ok := object[key]
+	if !ok || string(raw) == "null" {
+		return "", false
+	}
+	if raw[0] == '"' {
+		if json.Unmarshal(raw, &value) != nil {
+			return "", false
+		}
+		return value, true
+	}
+	var buf bytes.Buffer
+	if json.Compact(&buf, raw) != nil {
+		return "", false
+	}
+	return buf.String(), true
+}
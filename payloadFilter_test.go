@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPayloadFilter(t *testing.T) {
+	var tests = []struct {
+		key     string
+		op      payloadFilterOperator
+		value   string
+		payload string
+		match   bool
+	}{
+		{"", filterEquals, "foo", "foo", true},
+		{"", filterEquals, "foo", "foobar", false},
+		{"", filterLike, "foo%", "foobar", true},
+		{"", filterLike, "foo_", "foobar", false},
+		{"", filterRegex, "^ba[rz]", "baz", true},
+		{"", filterRegex, "^ba[rz]", "foo", false},
+		{"table", filterEquals, "invoices", `{"table": "invoices", "id": 1}`, true},
+		{"table", filterEquals, "invoices", `{"table": "orders"}`, false},
+		{"table", filterEquals, "invoices", `{"id": 1}`, false},
+		{"table", filterEquals, "invoices", `invoices`, false},
+		{"id", filterEquals, "1", `{"id": 1}`, true},
+		{"id", filterEquals, "1", `{"id": null}`, false},
+		{"tags", filterEquals, `["a","b"]`, `{"tags": [ "a", "b" ]}`, true},
+		{"table", filterLike, "inv%", `{"table": "invoices"}`, true},
+	}
+
+	for i, ts := range tests {
+		f, err := newPayloadFilter(ts.key, ts.op, ts.value)
+		if err != nil {
+			t.Fatalf("test %d: unexpected error %s", i, err)
+		}
+		if f.Match(ts.payload) != ts.match {
+			t.Errorf("test %d: Match(%q) returned %v", i, ts.payload, !ts.match)
+		}
+	}
+
+	_, err := newPayloadFilter("", filterRegex, "(")
+	if err == nil {
+		t.Errorf("invalid regular expression accepted")
+	}
+}
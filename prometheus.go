@@ -3,47 +3,12 @@ package main
 import (
 	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"net/http"
-	"runtime"
 	"time"
 )
 
-type gcStatsCollector struct {
-	pauseTotalDesc *prometheus.Desc
-	numGCDesc *prometheus.Desc
-}
-
-func newGCStatsCollector() *gcStatsCollector {
-	return &gcStatsCollector{
-		pauseTotalDesc: prometheus.NewDesc(
-			"allas_gc_pause_seconds_total",
-			"how much total time has been spent in garbage collector pauses",
-			nil,
-			nil,
-		),
-		numGCDesc: prometheus.NewDesc(
-			"allas_gc_pauses_total",
-			"how many times the garbage collector has run",
-			nil,
-			nil,
-		),
-	}
-}
-
-func (c *gcStatsCollector) Describe(ch chan<- *prometheus.Desc) {
-	ch <- c.pauseTotalDesc
-	ch <- c.numGCDesc
-}
-
-func (c *gcStatsCollector) Collect(ch chan<- prometheus.Metric) {
-	var m runtime.MemStats
-	runtime.ReadMemStats(&m)
-
-	ch <- prometheus.MustNewConstMetric(c.pauseTotalDesc, prometheus.CounterValue, float64(m.PauseTotalNs) / 1000000000.0)
-	ch <- prometheus.MustNewConstMetric(c.numGCDesc, prometheus.CounterValue, float64(m.NumGC))
-}
-
 type PrometheusConfig struct {
 	Enabled bool
 	Listen ListenConfig
@@ -51,7 +16,7 @@ type PrometheusConfig struct {
 	registry *prometheus.Registry
 	startupTimeDesc *prometheus.Desc
 	startupTimeMetric prometheus.Metric
-	gcStatsCollector *gcStatsCollector
+	mux *http.ServeMux
 }
 
 func (c *PrometheusConfig) RegisterMetricsCollector(coll prometheus.Collector) error {
@@ -71,9 +36,31 @@ func (w elogWrapper) Println(v ...interface{}) {
 var MetricClientConnections prometheus.Gauge
 var MetricNotificationsReceived prometheus.Counter
 var MetricNotificationsDispatched prometheus.Counter
+var MetricNotificationsCoalesced prometheus.Counter
+var MetricNotificationsFiltered prometheus.Counter
+var MetricNotificationsRateLimited prometheus.Counter
+var MetricChannelPermissionDenied *prometheus.CounterVec
+var MetricTransformerFailures prometheus.Counter
+var MetricPayloadFetches *prometheus.CounterVec
 var MetricListensExecuted prometheus.Counter
 var MetricUnlistensExecuted prometheus.Counter
 var MetricSlowClientsTerminated prometheus.Counter
+var MetricNotificationsDropped *prometheus.CounterVec
+var MetricChannelNotificationsReceived *prometheus.CounterVec
+var MetricChannelNotificationsDispatched *prometheus.CounterVec
+var MetricChannelListeners *prometheus.GaugeVec
+var MetricDatabaseSlowClientsTerminated *prometheus.CounterVec
+var MetricDatabaseAuthFailures *prometheus.CounterVec
+var MetricNotificationDeliveryLatency prometheus.Histogram
+var MetricNotificationProducerLatency prometheus.Histogram
+var MetricUpstreamPingDuration prometheus.Histogram
+var MetricUpstreamPingFailures prometheus.Counter
+var MetricUpstreamPingTimeouts prometheus.Counter
+var MetricUpstreamReconnectDelay prometheus.Histogram
+var MetricUpstreamConnectionAttemptsFailed prometheus.Counter
+var MetricUpstreamDisconnects prometheus.Counter
+var MetricUpstreamReconnects prometheus.Counter
+var MetricUpstreamOutageDuration prometheus.Histogram
 
 func (cfg *PrometheusConfig) InitializeMetrics(r *prometheus.Registry) error {
 	var err error
@@ -110,6 +97,66 @@ func (cfg *PrometheusConfig) InitializeMetrics(r *prometheus.Registry) error {
 		return err
 	}
 
+	MetricNotificationsCoalesced = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "allas",
+		Name: "notifications_coalesced_total",
+		Help: "how many notifications have been suppressed as duplicates of a recent notification",
+	})
+	err = r.Register(MetricNotificationsCoalesced)
+	if err != nil {
+		return err
+	}
+
+	MetricNotificationsFiltered = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "allas",
+		Name: "notifications_filtered_total",
+		Help: "how many notifications have not been delivered to a client because of its payload filter",
+	})
+	err = r.Register(MetricNotificationsFiltered)
+	if err != nil {
+		return err
+	}
+
+	MetricNotificationsRateLimited = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "allas",
+		Name: "notifications_rate_limited_total",
+		Help: "how many notifications have not been delivered to a client because of a rate limit",
+	})
+	err = r.Register(MetricNotificationsRateLimited)
+	if err != nil {
+		return err
+	}
+
+	MetricChannelPermissionDenied = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "allas",
+		Name: "channel_permission_denied_total",
+		Help: "how many LISTEN commands have been rejected because the channel is not allowed",
+	}, []string{"database"})
+	err = r.Register(MetricChannelPermissionDenied)
+	if err != nil {
+		return err
+	}
+
+	MetricTransformerFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "allas",
+		Name: "transformer_failures_total",
+		Help: "how many times a payload transformer has failed",
+	})
+	err = r.Register(MetricTransformerFailures)
+	if err != nil {
+		return err
+	}
+
+	MetricPayloadFetches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "allas",
+		Name: "payload_fetches_total",
+		Help: "how many payload references have been resolved, by result (cache_hit, fetched or failed)",
+	}, []string{"result"})
+	err = r.Register(MetricPayloadFetches)
+	if err != nil {
+		return err
+	}
+
 	MetricNotificationsDispatched = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: "allas",
 		Name: "notifications_dispatched_total",
@@ -150,8 +197,178 @@ func (cfg *PrometheusConfig) InitializeMetrics(r *prometheus.Registry) error {
 		return err
 	}
 
-	cfg.gcStatsCollector = newGCStatsCollector()
-	err = r.Register(cfg.gcStatsCollector)
+	MetricNotificationsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "allas",
+		Name: "notifications_dropped_total",
+		Help: "how many notifications have been dropped because of the slow client policy",
+	}, []string{"database"})
+	err = r.Register(MetricNotificationsDropped)
+	if err != nil {
+		return err
+	}
+
+	MetricChannelNotificationsReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "allas",
+		Name: "channel_notifications_received_total",
+		Help: "how many notifications have been received from the PostgreSQL server on each channel",
+	}, []string{"channel"})
+	err = r.Register(MetricChannelNotificationsReceived)
+	if err != nil {
+		return err
+	}
+
+	MetricChannelNotificationsDispatched = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "allas",
+		Name: "channel_notifications_dispatched_total",
+		Help: "how many notifications have been sent to the clients of each database on each channel",
+	}, []string{"database", "channel"})
+	err = r.Register(MetricChannelNotificationsDispatched)
+	if err != nil {
+		return err
+	}
+
+	MetricChannelListeners = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "allas",
+		Name: "channel_listeners",
+		Help: "how many clients are listening on each channel",
+	}, []string{"channel"})
+	err = r.Register(MetricChannelListeners)
+	if err != nil {
+		return err
+	}
+
+	MetricDatabaseSlowClientsTerminated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "allas",
+		Name: "database_slow_clients_terminated_total",
+		Help: "how many clients of each database have been terminated because they could not keep up",
+	}, []string{"database"})
+	err = r.Register(MetricDatabaseSlowClientsTerminated)
+	if err != nil {
+		return err
+	}
+
+	MetricDatabaseAuthFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "allas",
+		Name: "database_auth_failures_total",
+		Help: "how many connection attempts to each database have failed authentication",
+	}, []string{"database"})
+	err = r.Register(MetricDatabaseAuthFailures)
+	if err != nil {
+		return err
+	}
+
+	MetricNotificationDeliveryLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "allas",
+		Name: "notification_delivery_latency_seconds",
+		Help: "time between receiving a notification from the PostgreSQL server and sending it to a client",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+	})
+	err = r.Register(MetricNotificationDeliveryLatency)
+	if err != nil {
+		return err
+	}
+
+	MetricNotificationProducerLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "allas",
+		Name: "notification_producer_latency_seconds",
+		Help: "time between the producer sending a notification, according to its payload, and allas sending it to a client",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+	})
+	err = r.Register(MetricNotificationProducerLatency)
+	if err != nil {
+		return err
+	}
+
+	MetricUpstreamPingDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "allas",
+		Name: "upstream_ping_duration_seconds",
+		Help: "how long successful pings to the PostgreSQL server took",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 4, 8),
+	})
+	err = r.Register(MetricUpstreamPingDuration)
+	if err != nil {
+		return err
+	}
+
+	MetricUpstreamPingFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "allas",
+		Name: "upstream_ping_failures_total",
+		Help: "how many pings to the PostgreSQL server have failed so far",
+	})
+	err = r.Register(MetricUpstreamPingFailures)
+	if err != nil {
+		return err
+	}
+
+	MetricUpstreamPingTimeouts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "allas",
+		Name: "upstream_ping_timeouts_total",
+		Help: "how many times the connection to the PostgreSQL server has been closed because a ping timed out",
+	})
+	err = r.Register(MetricUpstreamPingTimeouts)
+	if err != nil {
+		return err
+	}
+
+	MetricUpstreamReconnectDelay = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "allas",
+		Name: "upstream_reconnect_delay_seconds",
+		Help: "how long allas waited before attempting to reconnect to the PostgreSQL server",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 10),
+	})
+	err = r.Register(MetricUpstreamReconnectDelay)
+	if err != nil {
+		return err
+	}
+
+	MetricUpstreamConnectionAttemptsFailed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "allas",
+		Name: "upstream_connection_attempts_failed_total",
+		Help: "the number of failed attempts to connect to the PostgreSQL server",
+	})
+	err = r.Register(MetricUpstreamConnectionAttemptsFailed)
+	if err != nil {
+		return err
+	}
+
+	MetricUpstreamDisconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "allas",
+		Name: "upstream_disconnects_total",
+		Help: "how many times the connection to the PostgreSQL server has been lost",
+	})
+	err = r.Register(MetricUpstreamDisconnects)
+	if err != nil {
+		return err
+	}
+
+	MetricUpstreamReconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "allas",
+		Name: "upstream_reconnects_total",
+		Help: "how many times the connection to the PostgreSQL server has been re-established after being lost",
+	})
+	err = r.Register(MetricUpstreamReconnects)
+	if err != nil {
+		return err
+	}
+
+	MetricUpstreamOutageDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "allas",
+		Name: "upstream_outage_duration_seconds",
+		Help: "how long allas was disconnected from the PostgreSQL server before reconnecting",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 14),
+	})
+	err = r.Register(MetricUpstreamOutageDuration)
+	if err != nil {
+		return err
+	}
+
+	err = r.Register(collectors.NewGoCollector(
+		collectors.WithGoCollectorRuntimeMetrics(collectors.MetricsAll),
+	))
+	if err != nil {
+		return err
+	}
+	err = r.Register(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
 	if err != nil {
 		return err
 	}
@@ -167,6 +384,12 @@ func (cfg *PrometheusConfig) Collect(ch chan<- prometheus.Metric) {
 	ch <- cfg.startupTimeMetric
 }
 
+// Serves handler under pattern alongside /metrics.  Setup must have been
+// called.
+func (cfg *PrometheusConfig) HandleFunc(pattern string, handler http.HandlerFunc) {
+	cfg.mux.HandleFunc(pattern, handler)
+}
+
 func (cfg *PrometheusConfig) Setup() error {
 	elogWrapper := elogWrapper{}
 	registry := prometheus.NewPedanticRegistry()
@@ -179,10 +402,10 @@ func (cfg *PrometheusConfig) Setup() error {
 	metricsHandler := promhttp.HandlerFor(registry, promhttp.HandlerOpts{
 		ErrorLog: elogWrapper,
 	})
-	muxer := http.NewServeMux()
-	muxer.Handle("/metrics", metricsHandler)
+	cfg.mux = http.NewServeMux()
+	cfg.mux.Handle("/metrics", metricsHandler)
 	s := &http.Server{
-		Handler: muxer,
+		Handler: cfg.mux,
 	}
 	l, err := cfg.Listen.Listen()
 	if err != nil {
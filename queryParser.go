@@ -3,14 +3,16 @@ package main
 /*
  * This file contains a parser for a really small subset of the Postgres SQL
  * dialect.  The objective is to only support LISTEN, UNLISTEN and trivial
- * "ping"-type SELECT statements.  Many queries accepted by Postgres proper are
- * rejected, but that's fine for our purposes -- in fact, this parser probably
- * tries to support way too many corner cases already.
+ * "ping"-type SELECT statements, plus a few allas-specific extensions such as
+ * LISTEN PATTERN, LISTEN .. WHERE and ACK.  Many queries accepted by Postgres
+ * proper are rejected, but that's fine for our purposes -- in fact, this
+ * parser probably tries to support way too many corner cases already.
  */
 
 import (
 	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 	"unicode/utf8"
 )
@@ -24,11 +26,17 @@ const (
 	tokDigit
 	tokSemicolon
 	tokStar
+	tokString
+	tokInteger
+	tokOperator
 )
 
 const (
 	flagAllowEOF               uint32 = 1
 	flagAllowQuotedIdentifiers        = 2
+	flagAllowStringLiterals           = 4
+	flagAllowIntegers                 = 8
+	flagAllowOperators                = 16
 )
 
 func (t queryParserTokenType) String() string {
@@ -43,6 +51,12 @@ func (t queryParserTokenType) String() string {
 		return "semicolon"
 	case tokStar:
 		return "asterisk"
+	case tokString:
+		return "string literal"
+	case tokInteger:
+		return "integer"
+	case tokOperator:
+		return "operator"
 	default:
 		panic(fmt.Sprintf("unrecognized token type %d", t))
 	}
@@ -104,6 +118,12 @@ func ParseQuery(rawinput string) (q FrontendQuery, err error) {
 		return parseListen(input)
 	case "unlisten":
 		return parseUnlisten(input)
+	case "ack":
+		return parseAck(input)
+	case "show":
+		return parseShow(input)
+	case "kill":
+		return parseKill(input)
 	default:
 		return nil, fmt.Errorf("parse error at or near %q", token.payload)
 	}
@@ -149,6 +169,21 @@ func unexpectedToken(token queryParserToken) error {
 	return fmt.Errorf("parse error: unexpected token %q", token.typ.String())
 }
 
+// If the identifier "pattern" is followed by a string literal, this is a
+// LISTEN PATTERN or UNLISTEN PATTERN command; otherwise "pattern" is just the
+// name of a channel.  Returns ok=false in the latter case.
+func parsePattern(input []rune) (pattern string, rest []rune, ok bool, err error) {
+	var token queryParserToken
+
+	rest, err = nextToken(input, &token, flagAllowEOF|flagAllowStringLiterals)
+	if err != nil {
+		return "", nil, false, err
+	} else if token.typ != tokString {
+		return "", input, false, nil
+	}
+	return token.payload, rest, true, nil
+}
+
 func parseListen(input []rune) (q FrontendQuery, err error) {
 	var token queryParserToken
 
@@ -156,12 +191,159 @@ func parseListen(input []rune) (q FrontendQuery, err error) {
 	if err != nil {
 		return nil, err
 	} else if token.typ == tokIdentifier {
-		return NewListenRequest(token.payload), semicolonOrEOF(input)
+		if token.payload == "pattern" {
+			pattern, rest, ok, err := parsePattern(input)
+			if err != nil {
+				return nil, err
+			} else if ok {
+				return NewListenPatternRequest(pattern), semicolonOrEOF(rest)
+			}
+		}
+		channel := token.payload
+
+		rest, err := nextToken(input, &token, flagAllowEOF)
+		if err != nil {
+			return nil, err
+		} else if token.typ == tokIdentifier && token.payload == "from" {
+			return parseListenFrom(channel, rest)
+		} else if token.typ == tokIdentifier && token.payload == "consumer" {
+			return parseListenConsumer(channel, rest)
+		} else if token.typ == tokIdentifier && token.payload == "where" {
+			return parseListenWhere(channel, rest)
+		}
+		return NewListenRequest(channel), semicolonOrEOF(input)
 	} else {
 		return nil, unexpectedToken(token)
 	}
 }
 
+func parseListenFrom(channel string, input []rune) (q FrontendQuery, err error) {
+	var token queryParserToken
+
+	input, err = nextToken(input, &token, flagAllowIntegers)
+	if err != nil {
+		return nil, err
+	} else if token.typ != tokInteger {
+		return nil, unexpectedToken(token)
+	}
+	seq, err := strconv.ParseUint(token.payload, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sequence number %q", token.payload)
+	}
+	return NewListenFromRequest(channel, seq), semicolonOrEOF(input)
+}
+
+// Parses the condition of LISTEN .. WHERE, which must be of the form
+//
+//   payload [->> 'key'] { = | LIKE | ~ } 'value'
+func parseListenWhere(channel string, input []rune) (q FrontendQuery, err error) {
+	var token queryParserToken
+	var key string
+
+	input, err = nextToken(input, &token, 0)
+	if err != nil {
+		return nil, err
+	} else if token.typ != tokIdentifier || token.payload != "payload" {
+		return nil, fmt.Errorf("parse error: condition must refer to \"payload\"")
+	}
+
+	input, err = nextToken(input, &token, flagAllowOperators)
+	if err != nil {
+		return nil, err
+	} else if token.typ == tokOperator && token.payload == "->>" {
+		input, err = nextToken(input, &token, flagAllowStringLiterals)
+		if err != nil {
+			return nil, err
+		} else if token.typ != tokString {
+			return nil, unexpectedToken(token)
+		} else if token.payload == "" {
+			return nil, fmt.Errorf("JSON key must not be empty")
+		}
+		key = token.payload
+
+		input, err = nextToken(input, &token, flagAllowOperators)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if token.typ != tokOperator && token.typ != tokIdentifier {
+		return nil, unexpectedToken(token)
+	}
+	op, err := parsePayloadFilterOperator(token.payload)
+	if err != nil {
+		return nil, err
+	}
+
+	input, err = nextToken(input, &token, flagAllowStringLiterals)
+	if err != nil {
+		return nil, err
+	} else if token.typ != tokString {
+		return nil, unexpectedToken(token)
+	}
+	return NewListenWhereRequest(channel, key, op, token.payload), semicolonOrEOF(input)
+}
+
+func parseListenConsumer(channel string, input []rune) (q FrontendQuery, err error) {
+	var token queryParserToken
+
+	input, err = nextToken(input, &token, flagAllowQuotedIdentifiers)
+	if err != nil {
+		return nil, err
+	} else if token.typ != tokIdentifier {
+		return nil, unexpectedToken(token)
+	}
+	return NewListenConsumerRequest(channel, token.payload), semicolonOrEOF(input)
+}
+
+func parseAck(input []rune) (q FrontendQuery, err error) {
+	var token queryParserToken
+
+	input, err = nextToken(input, &token, flagAllowIntegers)
+	if err != nil {
+		return nil, err
+	} else if token.typ != tokInteger {
+		return nil, unexpectedToken(token)
+	}
+	offset, err := strconv.ParseUint(token.payload, 10, 31)
+	if err != nil {
+		return nil, fmt.Errorf("invalid offset %q", token.payload)
+	}
+	return NewAckRequest(uint32(offset)), semicolonOrEOF(input)
+}
+
+// SHOW and KILL are only accepted in the admin console database, but we don't
+// know which database we're in here.  See RestrictQuery.
+func parseShow(input []rune) (q FrontendQuery, err error) {
+	var token queryParserToken
+
+	input, err = nextToken(input, &token, 0)
+	if err != nil {
+		return nil, err
+	} else if token.typ != tokIdentifier {
+		return nil, unexpectedToken(token)
+	}
+	if _, ok := adminShowColumns[token.payload]; !ok {
+		return nil, fmt.Errorf("parse error at or near %q", token.payload)
+	}
+	return NewShowRequest(token.payload), semicolonOrEOF(input)
+}
+
+func parseKill(input []rune) (q FrontendQuery, err error) {
+	var token queryParserToken
+
+	input, err = nextToken(input, &token, flagAllowIntegers)
+	if err != nil {
+		return nil, err
+	} else if token.typ != tokInteger {
+		return nil, unexpectedToken(token)
+	}
+	id, err := strconv.ParseInt(token.payload, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client id %q", token.payload)
+	}
+	return NewKillRequest(id), semicolonOrEOF(input)
+}
+
 func parseUnlisten(input []rune) (q FrontendQuery, err error) {
 	var token queryParserToken
 
@@ -171,6 +353,14 @@ func parseUnlisten(input []rune) (q FrontendQuery, err error) {
 	} else if token.typ == tokStar {
 		return NewWildcardUnlistenRequest(), semicolonOrEOF(input)
 	} else if token.typ == tokIdentifier {
+		if token.payload == "pattern" {
+			pattern, rest, ok, err := parsePattern(input)
+			if err != nil {
+				return nil, err
+			} else if ok {
+				return NewUnlistenPatternRequest(pattern), semicolonOrEOF(rest)
+			}
+		}
 		return NewUnlistenRequest(token.payload), semicolonOrEOF(input)
 	} else {
 		return nil, unexpectedToken(token)
@@ -193,6 +383,12 @@ foundComment:
 	r := input[0]
 	if flags&flagAllowQuotedIdentifiers > 0 && r == '"' {
 		return readQuotedIdentifier(input[1:], token)
+	} else if flags&flagAllowStringLiterals > 0 && r == '\'' {
+		return readStringLiteral(input[1:], token)
+	} else if flags&flagAllowIntegers > 0 && r >= '0' && r <= '9' {
+		return readInteger(input, token)
+	} else if flags&flagAllowOperators > 0 && isOperatorStart(input) {
+		return readOperator(input, token)
 	} else if isIdentifierStart(r) {
 		return readIdentifier(input, token)
 	} else if r == '1' {
@@ -267,6 +463,48 @@ func readDigit(input []rune, token *queryParserToken) (rest []rune, err error) {
 	}
 }
 
+func readInteger(input []rune, token *queryParserToken) (rest []rune, err error) {
+	length := 0
+	for length < len(input) && input[length] >= '0' && input[length] <= '9' {
+		length++
+	}
+	if length < len(input) && isIdentifierContinuation(input[length]) {
+		return nil, errors.New("trailing junk after numeric literal")
+	}
+	token.payload = string(input[:length])
+	token.typ = tokInteger
+	return input[length:], nil
+}
+
+// These should match the "self" and "op_chars" rules in
+// src/backend/parser/scan.l, minus the characters we give a meaning of their
+// own to.
+const operatorCharacters string = "+-/<>=~!@#%^&|`?"
+
+func isOperatorStart(input []rune) bool {
+	if strings.IndexRune(operatorCharacters, input[0]) == -1 {
+		return false
+	}
+	// comments take precedence
+	if len(input) > 1 && (string(input[:2]) == "--" || string(input[:2]) == "/*") {
+		return false
+	}
+	return true
+}
+
+func readOperator(input []rune, token *queryParserToken) (rest []rune, err error) {
+	length := 1
+	for length < len(input) && strings.IndexRune(operatorCharacters, input[length]) != -1 {
+		if length+1 < len(input) && (string(input[length:length+2]) == "--" || string(input[length:length+2]) == "/*") {
+			break
+		}
+		length++
+	}
+	token.payload = string(input[:length])
+	token.typ = tokOperator
+	return input[length:], nil
+}
+
 func isIdentifierStart(r rune) bool {
 	if r == '_' {
 		return true
@@ -315,6 +553,29 @@ func readQuotedIdentifier(input []rune, token *queryParserToken) (rest []rune, e
 	return nil, errQueryParserUnexpectedEOF
 }
 
+// Reads a standard-conforming string literal; backslashes are not special.
+func readStringLiteral(input []rune, token *queryParserToken) (rest []rune, err error) {
+	var sb strings.Builder
+	for i := 0; i < len(input); i++ {
+		char := input[i]
+
+		if char == '\'' {
+			if i+1 < len(input) && input[i+1] == '\'' {
+				sb.WriteRune('\'')
+				i++
+				continue
+			}
+			token.payload = sb.String()
+			token.typ = tokString
+			return input[i+1:], nil
+		}
+
+		sb.WriteRune(char)
+	}
+
+	return nil, errQueryParserUnexpectedEOF
+}
+
 func readIdentifier(input []rune, token *queryParserToken) (rest []rune, err error) {
 	i := input
 	input = input[1:]
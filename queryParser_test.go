@@ -32,6 +32,46 @@ func TestQueryParser(t *testing.T) {
 		{`listen "foo""bar`, "error", errQueryParserUnexpectedEOF.Error()},
 		{`listen *`, "error", `parse error: unexpected token "asterisk"`},
 		{`unlisten *`, "UnlistenRequest", ""},
+		{`listen pattern 'orders_%'`, "ListenPatternRequest", ""},
+		{`LISTEN PATTERN 'it''s';`, "ListenPatternRequest", ""},
+		{`listen pattern`, "ListenRequest", ""},
+		{`listen pattern;`, "ListenRequest", ""},
+		{`listen pattern 'foo`, "error", errQueryParserUnexpectedEOF.Error()},
+		{`listen 'foo'`, "error", "parse error"},
+		{`unlisten pattern 'orders_%'`, "UnlistenPatternRequest", ""},
+		{`listen foo from 123`, "ListenFromRequest", ""},
+		{`listen "foo" FROM 0;`, "ListenFromRequest", ""},
+		{`listen foo from`, "error", errQueryParserUnexpectedEOF.Error()},
+		{`listen foo from bar`, "error", `parse error: unexpected token "identifier"`},
+		{`listen foo from 12a`, "error", "trailing junk after numeric literal"},
+		{`listen foo from 99999999999999999999`, "error", `invalid sequence number "99999999999999999999"`},
+		{`listen foo 1`, "error", "unexpected data after query string"},
+		{`unlisten pattern`, "UnlistenRequest", ""},
+		{`listen foo consumer bar`, "ListenConsumerRequest", ""},
+		{`listen foo consumer "Bar";`, "ListenConsumerRequest", ""},
+		{`listen foo consumer`, "error", errQueryParserUnexpectedEOF.Error()},
+		{`listen foo consumer 'bar'`, "error", "parse error"},
+		{`listen foo where payload = 'bar'`, "ListenWhereRequest", ""},
+		{`listen foo where payload like 'bar%';`, "ListenWhereRequest", ""},
+		{`listen foo where payload ~ '^bar'`, "ListenWhereRequest", ""},
+		{`listen foo where payload->>'table' = 'invoices'`, "ListenWhereRequest", ""},
+		{`listen foo where payload ->> 'table'--comment
+			= 'invoices'`, "ListenWhereRequest", ""},
+		{`listen foo where payload`, "error", errQueryParserUnexpectedEOF.Error()},
+		{`listen foo where payload < 'bar'`, "error", "operator does not exist: <"},
+		{`listen foo where payload = bar`, "error", `parse error: unexpected token "identifier"`},
+		{`listen foo where extra = 'bar'`, "error", `parse error: condition must refer to "payload"`},
+		{`listen foo where payload->>'' = 'bar'`, "error", "JSON key must not be empty"},
+		{`ack 123`, "AckRequest", ""},
+		{`ack 123;`, "AckRequest", ""},
+		{`ack`, "error", errQueryParserUnexpectedEOF.Error()},
+		{`ack 2147483648`, "error", `invalid offset "2147483648"`},
+		{`show clients`, "ShowRequest", ""},
+		{`SHOW STATS;`, "ShowRequest", ""},
+		{`show pools`, "error", `parse error at or near "pools"`},
+		{`show`, "error", errQueryParserUnexpectedEOF.Error()},
+		{`kill 12`, "KillRequest", ""},
+		{`kill foo`, "error", `parse error: unexpected token "identifier"`},
 		{"notify", "error", `parse error at or near "notify"`},
 	}
 
@@ -71,6 +111,78 @@ func TestQueryParser(t *testing.T) {
 					t.Errorf("test %d failed: unexpected msg %+#v; was expecting UnlistenRequest", n, q)
 				}
 			}
+		case "ListenFromRequest":
+			if err != nil {
+				t.Errorf("test %d failed: unexpected error %q", n, err)
+			} else {
+				_, ok := q.(listenFromRequest)
+				if !ok {
+					t.Errorf("test %d failed: unexpected msg %+#v; was expecting ListenFromRequest", n, q)
+				}
+			}
+		case "ListenConsumerRequest":
+			if err != nil {
+				t.Errorf("test %d failed: unexpected error %q", n, err)
+			} else {
+				_, ok := q.(listenConsumerRequest)
+				if !ok {
+					t.Errorf("test %d failed: unexpected msg %+#v; was expecting ListenConsumerRequest", n, q)
+				}
+			}
+		case "ListenWhereRequest":
+			if err != nil {
+				t.Errorf("test %d failed: unexpected error %q", n, err)
+			} else {
+				_, ok := q.(listenWhereRequest)
+				if !ok {
+					t.Errorf("test %d failed: unexpected msg %+#v; was expecting ListenWhereRequest", n, q)
+				}
+			}
+		case "AckRequest":
+			if err != nil {
+				t.Errorf("test %d failed: unexpected error %q", n, err)
+			} else {
+				_, ok := q.(ackRequest)
+				if !ok {
+					t.Errorf("test %d failed: unexpected msg %+#v; was expecting AckRequest", n, q)
+				}
+			}
+		case "ListenPatternRequest":
+			if err != nil {
+				t.Errorf("test %d failed: unexpected error %q", n, err)
+			} else {
+				_, ok := q.(listenPatternRequest)
+				if !ok {
+					t.Errorf("test %d failed: unexpected msg %+#v; was expecting ListenPatternRequest", n, q)
+				}
+			}
+		case "UnlistenPatternRequest":
+			if err != nil {
+				t.Errorf("test %d failed: unexpected error %q", n, err)
+			} else {
+				_, ok := q.(unlistenPatternRequest)
+				if !ok {
+					t.Errorf("test %d failed: unexpected msg %+#v; was expecting UnlistenPatternRequest", n, q)
+				}
+			}
+		case "ShowRequest":
+			if err != nil {
+				t.Errorf("test %d failed: unexpected error %q", n, err)
+			} else {
+				_, ok := q.(showRequest)
+				if !ok {
+					t.Errorf("test %d failed: unexpected msg %+#v; was expecting ShowRequest", n, q)
+				}
+			}
+		case "KillRequest":
+			if err != nil {
+				t.Errorf("test %d failed: unexpected error %q", n, err)
+			} else {
+				_, ok := q.(killRequest)
+				if !ok {
+					t.Errorf("test %d failed: unexpected msg %+#v; was expecting KillRequest", n, q)
+				}
+			}
 		case "TrivialSelect":
 			if err != nil {
 				t.Errorf("test %d failed: unexpected error %q", n, err)
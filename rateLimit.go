@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// RateLimitAction determines what happens to notifications exceeding a rate
+// limit.
+type RateLimitAction int
+
+const (
+	// Excess notifications are discarded.
+	RateLimitDrop RateLimitAction = iota
+	// Excess notifications are discarded, and replaced by a single
+	// notification on the same channel saying how many were dropped.
+	RateLimitCollapse
+)
+
+func ParseRateLimitAction(s string) (RateLimitAction, error) {
+	switch s {
+	case "drop":
+		return RateLimitDrop, nil
+	case "collapse":
+		return RateLimitCollapse, nil
+	default:
+		return 0, fmt.Errorf("unrecognized rate limit action %q", s)
+	}
+}
+
+func (a RateLimitAction) String() string {
+	switch a {
+	case RateLimitDrop:
+		return "drop"
+	case RateLimitCollapse:
+		return "collapse"
+	default:
+		panic("unknown rate limit action")
+	}
+}
+
+type RateLimitConfig struct {
+	// notifications per second; zero means no limit
+	Rate   float64
+	Burst  int
+	Action RateLimitAction
+}
+
+// ChannelRateLimitConfig specifies the rate limit of every channel matching
+// Channels, for each client separately.
+type ChannelRateLimitConfig struct {
+	Channels *channelPattern
+	RateLimitConfig
+}
+
+// tokenBucket implements a token bucket rate limiter.  It's not safe for
+// concurrent use.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(cfg RateLimitConfig) *tokenBucket {
+	return &tokenBucket{
+		rate:   cfg.Rate,
+		burst:  float64(cfg.Burst),
+		tokens: float64(cfg.Burst),
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if !b.last.IsZero() {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+}
+
+// Returns true if there's a token in the bucket.
+func (b *tokenBucket) Available(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= 1
+}
+
+// Takes a token out of the bucket.  The caller must have checked that one is
+// available.
+func (b *tokenBucket) Take() {
+	b.tokens--
+}
+
+// Returns how long it will take until the next token is available.
+func (b *tokenBucket) Delay(now time.Time) time.Duration {
+	b.refill(now)
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
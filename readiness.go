@@ -0,0 +1,176 @@
+package main
+
+import (
+	"github.com/johto/notifyutils/notifydispatcher"
+	"github.com/lib/pq"
+
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var errUpstreamNotConnected = errors.New("not connected to the server")
+
+// How long the result of the end-to-end check is reused for.  Orchestrators
+// and load balancers can poll /readyz often, and every check costs a round
+// trip through the server.
+const readinessCheckInterval = time.Second
+
+// ReadinessConfig enables the end-to-end check of /readyz, which sends a
+// NOTIFY on Channel and waits up to Timeout for it to come back through the
+// listener connection.
+type ReadinessConfig struct {
+	Enabled bool
+	Channel string
+	Timeout time.Duration
+}
+
+// readinessChecker decides whether we're able to deliver notifications.
+type readinessChecker struct {
+	cfg      ReadinessConfig
+	upstream *upstreamStatus
+
+	// nil if the end-to-end check is disabled
+	db     *sql.DB
+	notify chan *pq.Notification
+	check  func() error
+
+	lock sync.Mutex
+	// closed when the notification with the payload has been received
+	waiters map[string]chan struct{}
+
+	// serialises the end-to-end checks, and protects the result of the last
+	// one
+	checkLock sync.Mutex
+	lastCheck time.Time
+	lastErr   error
+}
+
+func newReadinessChecker(cfg ReadinessConfig, upstream *upstreamStatus, connector *pq.Connector) *readinessChecker {
+	rc := &readinessChecker{
+		cfg:      cfg,
+		upstream: upstream,
+	}
+	if cfg.Enabled {
+		rc.db = sql.OpenDB(connector)
+		rc.db.SetMaxIdleConns(1)
+		rc.notify = make(chan *pq.Notification, 16)
+		rc.waiters = make(map[string]chan struct{})
+		rc.check = rc.roundTrip
+	}
+	return rc
+}
+
+// Starts listening on the readiness check channel.  Listen waits for the
+// connection to be established, so this runs in its own goroutine.
+func (rc *readinessChecker) Start(nd *notifydispatcher.NotifyDispatcher) {
+	if rc.db == nil {
+		return
+	}
+	go func() {
+		err := nd.Listen(rc.cfg.Channel, rc.notify)
+		if err != nil {
+			elog.Fatalf("could not listen on channel %q: %s", rc.cfg.Channel, err)
+		}
+		for n := range rc.notify {
+			rc.lock.Lock()
+			waiter, ok := rc.waiters[n.Extra]
+			if ok {
+				close(waiter)
+				delete(rc.waiters, n.Extra)
+			}
+			rc.lock.Unlock()
+		}
+	}()
+}
+
+// Sends a notification with a random payload, and waits for it to arrive.
+func (rc *readinessChecker) roundTrip() error {
+	token := make([]byte, 16)
+	_, err := rand.Read(token)
+	if err != nil {
+		return err
+	}
+	payload := hex.EncodeToString(token)
+
+	waiter := make(chan struct{})
+	rc.lock.Lock()
+	rc.waiters[payload] = waiter
+	rc.lock.Unlock()
+	defer func() {
+		rc.lock.Lock()
+		delete(rc.waiters, payload)
+		rc.lock.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), rc.cfg.Timeout)
+	defer cancel()
+	_, err = rc.db.ExecContext(ctx, "SELECT pg_notify($1, $2)", rc.cfg.Channel, payload)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-waiter:
+		return nil
+	case <-ctx.Done():
+		return errors.New("timed out waiting for the notification")
+	}
+}
+
+// Runs the end-to-end check, unless one has completed within the last
+// readinessCheckInterval, in which case its result is returned instead.
+// Concurrent callers wait for a single check.
+func (rc *readinessChecker) cachedCheck() error {
+	rc.checkLock.Lock()
+	defer rc.checkLock.Unlock()
+
+	if !rc.lastCheck.IsZero() && time.Since(rc.lastCheck) < readinessCheckInterval {
+		return rc.lastErr
+	}
+	rc.lastErr = rc.check()
+	rc.lastCheck = time.Now()
+	return rc.lastErr
+}
+
+type healthStatus struct {
+	Status     string `json:"status"`
+	Upstream   string `json:"upstream,omitempty"`
+	NotifyTest string `json:"notify_round_trip,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Implements /healthz.  If we can respond at all, we're alive.
+func (rc *readinessChecker) serveHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, healthStatus{Status: "ok"})
+}
+
+// Implements /readyz.
+func (rc *readinessChecker) serveReady(w http.ResponseWriter, r *http.Request) {
+	status := healthStatus{Status: "ready", Upstream: "connected"}
+
+	connected, _, _, _ := rc.upstream.Snapshot()
+	if !connected {
+		status.Status = "not ready"
+		status.Upstream = "disconnected"
+		status.Error = errUpstreamNotConnected.Error()
+		writeJSON(w, http.StatusServiceUnavailable, status)
+		return
+	}
+	if rc.check != nil {
+		err := rc.cachedCheck()
+		if err != nil {
+			status.Status = "not ready"
+			status.NotifyTest = "failed"
+			status.Error = err.Error()
+			writeJSON(w, http.StatusServiceUnavailable, status)
+			return
+		}
+		status.NotifyTest = "ok"
+	}
+	writeJSON(w, http.StatusOK, status)
+}
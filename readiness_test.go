@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReadinessEndpoints(t *testing.T) {
+	upstream := &upstreamStatus{}
+	rc := newReadinessChecker(ReadinessConfig{}, upstream, nil)
+
+	check := func(handler http.HandlerFunc, status int, body string) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("GET", "/", nil))
+		if rec.Code != status {
+			t.Errorf("status %d; expected %d", rec.Code, status)
+		}
+		if strings.TrimSpace(rec.Body.String()) != body {
+			t.Errorf("body %q; expected %q", rec.Body.String(), body)
+		}
+	}
+
+	check(rc.serveHealth, http.StatusOK, `{"status":"ok"}`)
+	check(rc.serveReady, http.StatusServiceUnavailable, `{"status":"not ready","upstream":"disconnected","error":"not connected to the server"}`)
+	upstream.SetConnected(false)
+	check(rc.serveReady, http.StatusOK, `{"status":"ready","upstream":"connected"}`)
+	upstream.SetDisconnected(errors.New("connection reset"))
+	check(rc.serveReady, http.StatusServiceUnavailable, `{"status":"not ready","upstream":"disconnected","error":"not connected to the server"}`)
+	check(rc.serveHealth, http.StatusOK, `{"status":"ok"}`)
+}
+
+func TestReadinessCheckCache(t *testing.T) {
+	upstream := &upstreamStatus{}
+	upstream.SetConnected(false)
+	rc := newReadinessChecker(ReadinessConfig{}, upstream, nil)
+	checks := 0
+	rc.check = func() error {
+		checks++
+		return errors.New("timed out waiting for the notification")
+	}
+
+	for i := 0; i < 3; i++ {
+		rec := httptest.NewRecorder()
+		rc.serveReady(rec, httptest.NewRequest("GET", "/", nil))
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Fatalf("status %d; expected %d", rec.Code, http.StatusServiceUnavailable)
+		}
+	}
+	if checks != 1 {
+		t.Fatalf("%d checks; expected the result of the first one to be reused", checks)
+	}
+
+	rc.lastCheck = rc.lastCheck.Add(-readinessCheckInterval)
+	rc.cachedCheck()
+	if checks != 2 {
+		t.Fatalf("%d checks; expected the result to have expired", checks)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"github.com/lib/pq"
+
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errNoReplayBuffer = errors.New("channel does not have a replay buffer")
+
+// ReplayConfig specifies the replay buffer of all channels starting with
+// Prefix.
+type ReplayConfig struct {
+	Prefix   string
+	MaxCount int
+	// zero means no age limit
+	MaxAge time.Duration
+}
+
+// replayBuffers keeps the most recent notifications received on channels with
+// a replay buffer, so that clients which were disconnected for a while can
+// catch up using LISTEN channel FROM seq.  Each notification is assigned a
+// sequence number, which is increased by one for every notification received
+// on the channel.  Sequence numbers start from 1 every time allas starts.
+type replayBuffers struct {
+	configs []ReplayConfig
+
+	lock     sync.Mutex
+	channels map[string]*replayBuffer
+}
+
+type replayBuffer struct {
+	cfg     *ReplayConfig
+	lastSeq uint64
+
+	// circular buffer of at most cfg.MaxCount entries, oldest first
+	entries []replayEntry
+	head    int
+	count   int
+}
+
+type replayEntry struct {
+	n        *notification
+	received time.Time
+}
+
+func newReplayBuffers(configs []ReplayConfig) *replayBuffers {
+	return &replayBuffers{
+		configs:  configs,
+		channels: make(map[string]*replayBuffer),
+	}
+}
+
+// Returns the configuration with the longest prefix matching channel, or nil.
+func (r *replayBuffers) config(channel string) *ReplayConfig {
+	var best *ReplayConfig
+	for i := range r.configs {
+		cfg := &r.configs[i]
+		if strings.HasPrefix(channel, cfg.Prefix) && (best == nil || len(cfg.Prefix) > len(best.Prefix)) {
+			best = cfg
+		}
+	}
+	return best
+}
+
+func (r *replayBuffers) HasBuffer(channel string) bool {
+	return r.config(channel) != nil
+}
+
+// Adds n to its channel's replay buffer and assigns it a sequence number.
+// Does nothing if the channel doesn't have a replay buffer.
+func (r *replayBuffers) Append(n *notification) {
+	cfg := r.config(n.Channel)
+	if cfg == nil {
+		return
+	}
+
+	now := time.Now()
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	buf, ok := r.channels[n.Channel]
+	if !ok {
+		buf = &replayBuffer{
+			cfg:     cfg,
+			entries: make([]replayEntry, cfg.MaxCount),
+		}
+		r.channels[n.Channel] = buf
+	}
+	buf.expire(now)
+
+	buf.lastSeq++
+	n.seq = buf.lastSeq
+	if buf.count == len(buf.entries) {
+		buf.entries[buf.head] = replayEntry{}
+		buf.head = (buf.head + 1) % len(buf.entries)
+		buf.count--
+	}
+	buf.entries[(buf.head+buf.count)%len(buf.entries)] = replayEntry{n, now}
+	buf.count++
+}
+
+// Returns the notifications on channel with a sequence number greater than
+// seq, oldest first.  If seq is greater than the sequence number of any
+// notification we have seen (presumably because allas has been restarted
+// since), all buffered notifications are returned.  gap is true if some of
+// the requested notifications are no longer in the buffer.
+func (r *replayBuffers) Since(channel string, seq uint64) (notifications []*pq.Notification, lastSeq uint64, gap bool, err error) {
+	if r.config(channel) == nil {
+		return nil, 0, false, errNoReplayBuffer
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	buf, ok := r.channels[channel]
+	if !ok {
+		return nil, 0, seq > 0, nil
+	}
+	buf.expire(time.Now())
+
+	if seq > buf.lastSeq {
+		seq = 0
+	}
+	oldestSeq := buf.lastSeq - uint64(buf.count) + 1
+	gap = seq+1 < oldestSeq
+
+	for i := 0; i < buf.count; i++ {
+		n := buf.entries[(buf.head+i)%len(buf.entries)].n
+		if n.seq > seq {
+			notifications = append(notifications, n.PqNotification())
+		}
+	}
+	return notifications, buf.lastSeq, gap, nil
+}
+
+// Removes entries older than cfg.MaxAge.  The caller must be holding the
+// lock of the replayBuffers.
+func (buf *replayBuffer) expire(now time.Time) {
+	if buf.cfg.MaxAge == 0 {
+		return
+	}
+	for buf.count > 0 {
+		e := &buf.entries[buf.head]
+		if now.Sub(e.received) <= buf.cfg.MaxAge {
+			break
+		}
+		*e = replayEntry{}
+		buf.head = (buf.head + 1) % len(buf.entries)
+		buf.count--
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"github.com/lib/pq"
+
+	"testing"
+)
+
+func TestReplayBuffers(t *testing.T) {
+	r := newReplayBuffers([]ReplayConfig{
+		{Prefix: "cache_", MaxCount: 3},
+		{Prefix: "cache_big_", MaxCount: 100},
+	})
+
+	if r.HasBuffer("other") {
+		t.Fatalf("channel without a matching prefix has a replay buffer")
+	}
+	_, _, _, err := r.Since("other", 0)
+	if err != errNoReplayBuffer {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	for _, payload := range []string{"1", "2", "3", "4", "5"} {
+		n := newNotification(&pq.Notification{Channel: "cache_users", Extra: payload})
+		r.Append(n)
+		if n.Extra != payload || n.seq == 0 {
+			t.Fatalf("unexpected sequence number %d for payload %q", n.seq, payload)
+		}
+	}
+
+	var tests = []struct {
+		seq      uint64
+		payloads string
+		gap      bool
+	}{
+		{0, "345", true},
+		{1, "345", true},
+		{2, "345", false},
+		{4, "5", false},
+		{5, "", false},
+		// from a previous incarnation of allas
+		{1000, "345", true},
+	}
+	for n, ts := range tests {
+		notifications, lastSeq, gap, err := r.Since("cache_users", ts.seq)
+		if err != nil {
+			t.Fatalf("test %d failed: unexpected error %q", n, err)
+		}
+		payloads := ""
+		for _, n := range notifications {
+			payloads += n.Extra
+		}
+		if payloads != ts.payloads || gap != ts.gap || lastSeq != 5 {
+			t.Errorf("test %d failed: got %q, gap %v, lastSeq %d", n, payloads, gap, lastSeq)
+		}
+	}
+
+	// the longest prefix wins
+	for i := 0; i < 10; i++ {
+		r.Append(newNotification(&pq.Notification{Channel: "cache_big_x"}))
+	}
+	notifications, _, gap, _ := r.Since("cache_big_x", 0)
+	if len(notifications) != 10 || gap {
+		t.Errorf("got %d notifications, gap %v; expected 10 and no gap", len(notifications), gap)
+	}
+}
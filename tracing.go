@@ -0,0 +1,82 @@
+package main
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+
+	"context"
+	"fmt"
+	"os"
+)
+
+// TracingConfig specifies where OpenTelemetry spans are exported to.
+type TracingConfig struct {
+	Enabled bool
+	// "otlp" or "file"
+	Exporter string
+	// host:port of the OTLP/HTTP collector
+	Endpoint string
+	Insecure bool
+	File     string
+	// fraction of the traces started by allas which are sampled
+	SampleRatio float64
+	ServiceName string
+}
+
+// The tracer used for all spans.  Until setupTracing has been called, it
+// doesn't record anything.
+var tracer trace.Tracer = otel.Tracer("allas")
+
+// Attribute keys of the spans.
+const (
+	attrChannel  = attribute.Key("allas.channel")
+	attrDatabase = attribute.Key("allas.database")
+	attrUser     = attribute.Key("allas.user")
+	attrClient   = attribute.Key("allas.client")
+	attrQuery    = attribute.Key("allas.query")
+	attrSQLState = attribute.Key("allas.sqlstate")
+)
+
+func setupTracing(cfg TracingConfig) error {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch cfg.Exporter {
+	case "otlp":
+		options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.Endpoint)}
+		if cfg.Insecure {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), options...)
+	case "file":
+		var fh *os.File
+		fh, err = os.OpenFile(cfg.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err == nil {
+			exporter, err = stdouttrace.New(stdouttrace.WithWriter(fh))
+		}
+	default:
+		err = fmt.Errorf("invalid exporter %q", cfg.Exporter)
+	}
+	if err != nil {
+		return err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", cfg.ServiceName),
+	))
+	if err != nil {
+		return err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	tracer = provider.Tracer("allas")
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTracingFileExporter(t *testing.T) {
+	oldProvider, oldTracer := otel.GetTracerProvider(), tracer
+	defer func() {
+		otel.SetTracerProvider(oldProvider)
+		tracer = oldTracer
+	}()
+
+	filename := filepath.Join(t.TempDir(), "spans.json")
+	err := setupTracing(TracingConfig{
+		Exporter:    "file",
+		File:        filename,
+		SampleRatio: 1.0,
+		ServiceName: "allas-test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, span := tracer.Start(context.Background(), "notification")
+	span.SetAttributes(attrChannel.String("foo"))
+	span.End()
+
+	provider := otel.GetTracerProvider().(*sdktrace.TracerProvider)
+	err = provider.Shutdown(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{`"Name":"notification"`, `"allas.channel"`, `"allas-test"`} {
+		if !strings.Contains(string(data), s) {
+			t.Errorf("%s not found in %s", s, data)
+		}
+	}
+}
+
+func TestTracingSampleRatio(t *testing.T) {
+	var c TracingConfig
+	err := readTracingSection(&c, map[string]interface{}{
+		"exporter":     "file",
+		"file":         "spans.json",
+		"sample_ratio": 1.5,
+	}, "tracing")
+	if err == nil {
+		t.Fatal("expected an error for sample_ratio 1.5")
+	}
+}
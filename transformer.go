@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PayloadTransformer rewrites the payloads of notifications received from the
+// server before they're delivered to anyone.  Transform is only ever called
+// from a single goroutine.
+type PayloadTransformer interface {
+	Transform(n *notification) (payload string, err error)
+}
+
+// TransformerFactory creates a PayloadTransformer from the options given in
+// its entry in the "transformers" configuration section.  Unrecognized
+// options should be reported as errors.
+type TransformerFactory func(options map[string]interface{}) (PayloadTransformer, error)
+
+var (
+	transformerFactoriesLock sync.Mutex
+	transformerFactories     = make(map[string]TransformerFactory)
+)
+
+// RegisterTransformer makes a transformer available for use in the
+// configuration file under name.  Custom transformers compiled into allas
+// should call this from an init function.
+func RegisterTransformer(name string, factory TransformerFactory) {
+	transformerFactoriesLock.Lock()
+	defer transformerFactoriesLock.Unlock()
+
+	if _, ok := transformerFactories[name]; ok {
+		panic(fmt.Sprintf("transformer %q registered twice", name))
+	}
+	transformerFactories[name] = factory
+}
+
+func newTransformer(name string, options map[string]interface{}) (PayloadTransformer, error) {
+	transformerFactoriesLock.Lock()
+	factory, ok := transformerFactories[name]
+	transformerFactoriesLock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unrecognized transformer %q", name)
+	}
+	return factory(options)
+}
+
+// TransformerConfig applies Transformer to the notifications on all channels
+// matching Channels.
+type TransformerConfig struct {
+	Channels    *channelPattern
+	Name        string
+	Transformer PayloadTransformer
+}
+
+// Runs the transformers matching n's channel, in the order they appear in
+// configs.  If a transformer fails, the notification is passed on as it was
+// before that transformer.
+func applyTransformers(configs []TransformerConfig, n *notification) {
+	for _, cfg := range configs {
+		if !cfg.Channels.Match(n.Channel) {
+			continue
+		}
+		payload, err := cfg.Transformer.Transform(n)
+		if err != nil {
+			elog.Warningf("transformer %q failed on a notification on channel %q: %s", cfg.Name, n.Channel, err)
+			MetricTransformerFailures.Inc()
+			continue
+		}
+		n.Extra = payload
+	}
+}
+
+func unrecognizedTransformerOption(name string, key string) error {
+	return fmt.Errorf("unrecognized option %q for transformer %q", key, name)
+}
+
+func init() {
+	RegisterTransformer("json_envelope", newJSONEnvelopeTransformer)
+	RegisterTransformer("add_timestamp", newAddTimestampTransformer)
+	RegisterTransformer("strip_prefix", newStripPrefixTransformer)
+}
+
+// jsonEnvelopeTransformer wraps the payload into a JSON object along with the
+// channel, the process ID of the notifying backend, the time the notification
+// was received and any static fields from the configuration.
+type jsonEnvelopeTransformer struct {
+	fields map[string]interface{}
+}
+
+func newJSONEnvelopeTransformer(options map[string]interface{}) (PayloadTransformer, error) {
+	t := &jsonEnvelopeTransformer{}
+	for key, value := range options {
+		switch key {
+		case "fields":
+			fields, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf(`option "fields" of transformer "json_envelope" must be a JSON object`)
+			}
+			t.fields = fields
+		default:
+			return nil, unrecognizedTransformerOption("json_envelope", key)
+		}
+	}
+	return t, nil
+}
+
+func (t *jsonEnvelopeTransformer) Transform(n *notification) (string, error) {
+	envelope := make(map[string]interface{}, len(t.fields)+4)
+	for key, value := range t.fields {
+		envelope[key] = value
+	}
+	envelope["channel"] = n.Channel
+	envelope["payload"] = n.Extra
+	envelope["pid"] = n.BePid
+	envelope["received_at"] = n.received.UTC().Format(time.RFC3339Nano)
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// addTimestampTransformer adds the time the notification was received to
+// payloads which are JSON objects.  Other payloads are left alone.
+type addTimestampTransformer struct {
+	field string
+}
+
+func newAddTimestampTransformer(options map[string]interface{}) (PayloadTransformer, error) {
+	t := &addTimestampTransformer{field: "received_at"}
+	for key, value := range options {
+		switch key {
+		case "field":
+			field, ok := value.(string)
+			if !ok || field == "" {
+				return nil, fmt.Errorf(`option "field" of transformer "add_timestamp" must be a non-empty text string`)
+			}
+			t.field = field
+		default:
+			return nil, unrecognizedTransformerOption("add_timestamp", key)
+		}
+	}
+	return t, nil
+}
+
+func (t *addTimestampTransformer) Transform(n *notification) (string, error) {
+	var object map[string]json.RawMessage
+	if json.Unmarshal([]byte(n.Extra), &object) != nil || object == nil {
+		return n.Extra, nil
+	}
+	timestamp, err := json.Marshal(n.received.UTC().Format(time.RFC3339Nano))
+	if err != nil {
+		return "", err
+	}
+	object[t.field] = timestamp
+	data, err := json.Marshal(object)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// stripPrefixTransformer removes a fixed prefix from payloads.  Payloads not
+// starting with the prefix are left alone.
+type stripPrefixTransformer struct {
+	prefix string
+}
+
+func newStripPrefixTransformer(options map[string]interface{}) (PayloadTransformer, error) {
+	t := &stripPrefixTransformer{}
+	for key, value := range options {
+		switch key {
+		case "prefix":
+			prefix, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf(`option "prefix" of transformer "strip_prefix" must be a text string`)
+			}
+			t.prefix = prefix
+		default:
+			return nil, unrecognizedTransformerOption("strip_prefix", key)
+		}
+	}
+	if t.prefix == "" {
+		return nil, fmt.Errorf(`option "prefix" of transformer "strip_prefix" must be specified`)
+	}
+	return t, nil
+}
+
+func (t *stripPrefixTransformer) Transform(n *notification) (string, error) {
+	return strings.TrimPrefix(n.Extra, t.prefix), nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"github.com/lib/pq"
+
+	"strings"
+	"testing"
+	"time"
+)
+
+type upperTransformer struct{}
+
+func (upperTransformer) Transform(n *notification) (string, error) {
+	return strings.ToUpper(n.Extra), nil
+}
+
+// Registered only once, since RegisterTransformer panics on duplicates and
+// tests can be run several times in the same process.
+func init() {
+	RegisterTransformer("test_upper", func(options map[string]interface{}) (PayloadTransformer, error) {
+		return upperTransformer{}, nil
+	})
+}
+
+func TestTransformers(t *testing.T) {
+	newConfig := func(channels, name string, options map[string]interface{}) TransformerConfig {
+		transformer, err := newTransformer(name, options)
+		if err != nil {
+			t.Fatalf("could not create transformer %q: %s", name, err)
+		}
+		return TransformerConfig{newGlobPattern(channels), name, transformer}
+	}
+	configs := []TransformerConfig{
+		newConfig("legacy_*", "strip_prefix", map[string]interface{}{"prefix": "ids:"}),
+		newConfig("legacy_*", "test_upper", nil),
+		newConfig("audit", "add_timestamp", map[string]interface{}{"field": "ts"}),
+		newConfig("wrapped", "json_envelope", map[string]interface{}{"fields": map[string]interface{}{"host": "db1"}}),
+	}
+
+	received := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	var tests = []struct {
+		channel  string
+		payload  string
+		expected string
+	}{
+		{"legacy_1", "ids:a,b", "A,B"},
+		{"legacy_1", "a,b", "A,B"},
+		{"audit", `{"id":1}`, `{"id":1,"ts":"2020-01-02T03:04:05Z"}`},
+		{"audit", `not json`, `not json`},
+		{"wrapped", "x", `{"channel":"wrapped","host":"db1","payload":"x","pid":42,"received_at":"2020-01-02T03:04:05Z"}`},
+		{"other", "ids:x", "ids:x"},
+	}
+	for i, ts := range tests {
+		n := newNotification(&pq.Notification{BePid: 42, Channel: ts.channel, Extra: ts.payload})
+		n.received = received
+		applyTransformers(configs, n)
+		if n.Extra != ts.expected {
+			t.Errorf("test %d: got payload %q; expected %q", i, n.Extra, ts.expected)
+		}
+	}
+
+	_, err := newTransformer("strip_prefix", map[string]interface{}{"prefix": "x", "foo": 1})
+	if err == nil {
+		t.Errorf("unrecognized option was accepted")
+	}
+	_, err = newTransformer("no_such_transformer", nil)
+	if err == nil {
+		t.Errorf("unrecognized transformer was accepted")
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type UpstreamConfig struct {
+	MinReconnectInterval time.Duration
+	MaxReconnectInterval time.Duration
+	// fraction of the reconnect interval to randomly add or subtract
+	ReconnectJitter float64
+
+	PingInterval time.Duration
+	// zero means no timeout
+	PingTimeout time.Duration
+
+	// zero means the Go default
+	TCPKeepAliveInterval time.Duration
+	// zero means the system default
+	TCPUserTimeout time.Duration
+
+	// channels we always LISTEN on, regardless of what clients are doing
+	Channels []string
+	// maximum number of channels LISTENed on in the server at a time; zero
+	// means no limit
+	MaxChannels int
+}
+
+// upstreamDialer implements pq.Dialer for the connections we make to the
+// PostgreSQL server.  It also remembers the most recently established
+// connection so that the pinger can forcibly close it if the server stops
+// responding.
+type upstreamDialer struct {
+	d net.Dialer
+
+	lock sync.Mutex
+	conn net.Conn
+}
+
+func (cfg UpstreamConfig) newDialer() *upstreamDialer {
+	ud := &upstreamDialer{}
+	ud.d.KeepAlive = cfg.TCPKeepAliveInterval
+	ud.d.Control = func(network, address string, rc syscall.RawConn) error {
+		if cfg.TCPUserTimeout == 0 || !strings.HasPrefix(network, "tcp") {
+			return nil
+		}
+		var sockoptErr error
+		err := rc.Control(func(fd uintptr) {
+			sockoptErr = setTCPUserTimeout(fd, cfg.TCPUserTimeout)
+		})
+		if err != nil {
+			return err
+		}
+		return sockoptErr
+	}
+	return ud
+}
+
+func (ud *upstreamDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	c, err := ud.d.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	ud.lock.Lock()
+	ud.conn = c
+	ud.lock.Unlock()
+	return c, nil
+}
+
+func (ud *upstreamDialer) Dial(network, address string) (net.Conn, error) {
+	return ud.DialContext(context.Background(), network, address)
+}
+
+func (ud *upstreamDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return ud.DialContext(ctx, network, address)
+}
+
+// Closes the most recently established connection, if any.
+func (ud *upstreamDialer) CloseConnection() {
+	ud.lock.Lock()
+	c := ud.conn
+	ud.conn = nil
+	ud.lock.Unlock()
+
+	if c != nil {
+		_ = c.Close()
+	}
+}
+
+// upstreamBackoff computes the time to wait between attempts to connect to
+// the server.  The interval starts at MinReconnectInterval and is doubled
+// after every failed attempt until MaxReconnectInterval is reached.  Not safe
+// for concurrent use.
+type upstreamBackoff struct {
+	cfg      UpstreamConfig
+	interval time.Duration
+}
+
+func (b *upstreamBackoff) Reset() {
+	b.interval = 0
+}
+
+func (b *upstreamBackoff) Next() time.Duration {
+	if b.interval == 0 {
+		b.interval = b.cfg.MinReconnectInterval
+	} else {
+		b.interval *= 2
+		if b.interval > b.cfg.MaxReconnectInterval {
+			b.interval = b.cfg.MaxReconnectInterval
+		}
+	}
+
+	delay := b.interval
+	if b.cfg.ReconnectJitter > 0 {
+		jitter := (rand.Float64()*2 - 1) * b.cfg.ReconnectJitter
+		delay += time.Duration(jitter * float64(delay))
+	}
+	return delay
+}
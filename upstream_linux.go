@@ -0,0 +1,13 @@
+package main
+
+import (
+	"golang.org/x/sys/unix"
+
+	"time"
+)
+
+const tcpUserTimeoutSupported = true
+
+func setTCPUserTimeout(fd uintptr, timeout time.Duration) error {
+	return unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, int(timeout/time.Millisecond))
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const tcpUserTimeoutSupported = false
+
+func setTCPUserTimeout(fd uintptr, timeout time.Duration) error {
+	return fmt.Errorf("TCP_USER_TIMEOUT is not supported on this platform")
+}